@@ -1,23 +1,253 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"go/format"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/lodjim/naboobase/configs"
+	_ "github.com/lodjim/naboobase/controllers"
+	"github.com/lodjim/naboobase/core"
 	"github.com/lodjim/naboobase/utils"
 )
 
+const usage = `Usage:
+  <executable> generate
+  <executable> export <collection> [--format jsonl|csv] [--filter <filter>] [--out <file>] [--db <name>]
+  <executable> import <collection> <file> [--format jsonl|csv] [--dry-run] [--batch-size <n>] [--db <name>]
+  <executable> backup [--out <file>] [--dir <directory>] [--every <duration>] [--keep <n>] [--db <name>]
+  <executable> restore <file> [--db <name>]
+  <executable> seed <collection> [--count <n>] [--seed <n>] [--batch-size <n>] [--db <name>]
+  <executable> rotate-keys [--db <name>]`
+
 func main() {
-	if len(os.Args) < 2 || os.Args[1] != "generate" {
-		fmt.Println("Usage: <executable> generate")
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	switch os.Args[1] {
+	case "generate":
+		generate()
+	case "export":
+		export(os.Args[2:])
+	case "import":
+		importFile(os.Args[2:])
+	case "backup":
+		backup(os.Args[2:])
+	case "restore":
+		restore(os.Args[2:])
+	case "seed":
+		seed(os.Args[2:])
+	case "rotate-keys":
+		rotateKeys(os.Args[2:])
+	default:
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+}
+
+func connect(dbName string) core.MongoDBconnector {
+	db := core.MongoDBconnector{}
+	if err := db.Connect(dbName); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	return db
+}
+
+func export(args []string) {
+	if len(args) < 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	collection := args[0]
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "jsonl", "Output format: jsonl or csv")
+	filter := flags.String("filter", "", "Filter expression selecting the records to export")
+	out := flags.String("out", "", "Output file, the standard output when empty")
+	dbName := flags.String("db", "naboobase", "Database name")
+	flags.Parse(args[1:])
+
+	output := os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		output = file
+	}
+
+	db := connect(*dbName)
+	count, err := core.ExportCollection(context.Background(), db, collection, *format, *filter, output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting %s: %v\n", collection, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d records from %s\n", count, collection)
+}
+
+func importFile(args []string) {
+	if len(args) < 2 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	collection, path := args[0], args[1]
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "Input format: jsonl or csv, guessed from the file extension when empty")
+	dryRun := flags.Bool("dry-run", false, "Validate every row without writing anything")
+	batchSize := flags.Int("batch-size", 500, "Number of records written at once")
+	dbName := flags.String("db", "naboobase", "Database name")
+	flags.Parse(args[2:])
+
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening input file: %v\n", err)
 		os.Exit(1)
 	}
+	defer file.Close()
 
+	db := connect(*dbName)
+	report, err := core.ImportCollection(context.Background(), db, collection, file, core.ImportOptions{
+		Format:    *format,
+		DryRun:    *dryRun,
+		BatchSize: *batchSize,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error importing %s: %v\n", collection, err)
+		os.Exit(1)
+	}
+	for _, rowError := range report.Errors {
+		fmt.Printf("row %d: %s\n", rowError.Row, rowError.Error)
+	}
+	if *dryRun {
+		fmt.Printf("Dry run: %d of %d rows are valid\n", report.Imported, report.Total)
+	} else {
+		fmt.Printf("Imported %d of %d rows into %s\n", report.Imported, report.Total, collection)
+	}
+	if len(report.Errors) != 0 {
+		os.Exit(1)
+	}
+}
+
+func backup(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("out", "", "Archive to write, a timestamped file of --dir when empty")
+	dir := flags.String("dir", configs.GetBackupDir(), "Directory of the timestamped backups")
+	every := flags.Duration("every", 0, "Keep running and write a backup at this interval")
+	keep := flags.Int("keep", configs.GetBackupRetention(), "Number of scheduled backups kept in --dir")
+	dbName := flags.String("db", "naboobase", "Database name")
+	flags.Parse(args)
+
+	db := connect(*dbName)
+	if *every > 0 {
+		fmt.Printf("Writing a backup into %s every %s\n", *dir, every.String())
+		core.ScheduleBackups(context.Background(), db, *dir, *every, *keep)
+		return
+	}
+
+	path := *out
+	if path == "" {
+		written, err := core.WriteBackupFile(context.Background(), db, *dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing the backup: %v\n", err)
+			os.Exit(1)
+		}
+		path = written
+	} else {
+		file, err := os.Create(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		if _, err := core.WriteBackup(context.Background(), db, file); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing the backup: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Backup written to %s\n", path)
+}
+
+func restore(args []string) {
+	if len(args) < 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	path := args[0]
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbName := flags.String("db", "naboobase", "Database name")
+	flags.Parse(args[1:])
+
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening the archive: %v\n", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	db := connect(*dbName)
+	manifest, err := core.RestoreBackup(context.Background(), db, file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error restoring %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Restored %d collections from the backup of %s\n", len(manifest.Collections), manifest.CreatedAt.Format(time.RFC3339))
+}
+
+func seed(args []string) {
+	if len(args) < 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	collection := args[0]
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	count := flags.Int("count", 10, "Number of records to generate")
+	randomSeed := flags.Int64("seed", 1, "Random seed, the same seed gives the same records")
+	batchSize := flags.Int("batch-size", 500, "Number of records written at once")
+	dbName := flags.String("db", "naboobase", "Database name")
+	flags.Parse(args[1:])
+
+	db := connect(*dbName)
+	inserted, err := core.SeedCollection(context.Background(), db, collection, core.SeedOptions{
+		Count:     *count,
+		Seed:      *randomSeed,
+		BatchSize: *batchSize,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error seeding %s after %d records: %v\n", collection, inserted, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Inserted %d records into %s\n", inserted, collection)
+}
+
+func rotateKeys(args []string) {
+	flags := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	dbName := flags.String("db", "naboobase", "Database name")
+	flags.Parse(args)
+
+	db := connect(*dbName)
+	rotated, err := core.RotateEncryptionKeys(context.Background(), db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error rotating the encryption keys after %d documents: %v\n", rotated, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Re-encrypted %d documents with the current key\n", rotated)
+}
+
+func generate() {
 	logger := log.New(os.Stdout, "PROTOC_LOG: ", log.Ldate|log.Ltime|log.Lshortfile)
 
 	jsonDir, err := os.ReadDir("json")
@@ -49,6 +279,14 @@ func main() {
 				os.Exit(1)
 			}
 
+			// Responses carry the computed fields of their model
+			if strings.HasSuffix(base, "_response") {
+				if err := addComputedFields(strings.TrimSuffix(base, "_response"), data); err != nil {
+					fmt.Printf("Error reading the computed fields: %v\n", err)
+					os.Exit(1)
+				}
+			}
+
 			// Parse structs and enums
 			structs := make(map[string]*utils.StructDefinition)
 			enums := make(map[string]utils.EnumDefinition)
@@ -88,3 +326,29 @@ func main() {
 	}
 	logger.Println("Processing completed.")
 }
+
+// addComputedFields copies into a response definition the computed fields of its model that
+// it doesn't declare itself.
+func addComputedFields(model string, data map[string]interface{}) error {
+	jsonData, err := ioutil.ReadFile(fmt.Sprintf("./json/%s.json", model))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var modelData map[string]interface{}
+	if err := json.Unmarshal(jsonData, &modelData); err != nil {
+		return err
+	}
+	for key, value := range modelData {
+		definition, ok := value.(map[string]interface{})
+		if !ok || definition["type"] != "computed" {
+			continue
+		}
+		if _, declared := data[key]; !declared {
+			data[key] = definition
+		}
+	}
+	return nil
+}
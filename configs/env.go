@@ -5,6 +5,8 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var err = godotenv.Load()
@@ -30,3 +32,85 @@ func GetExpirationTime() int {
 	}
 	return expirationDate
 }
+
+func GetBackupDir() string {
+	dir := os.Getenv("BACKUP_DIR")
+	if dir == "" {
+		return "./backups"
+	}
+	return dir
+}
+
+// GetBackupInterval returns how often scheduled backups run, 0 when they are disabled.
+func GetBackupInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("BACKUP_INTERVAL"))
+	if err != nil {
+		return 0
+	}
+	return interval
+}
+
+func GetBackupRetention() int {
+	retention, err := strconv.Atoi(os.Getenv("BACKUP_RETENTION"))
+	if err != nil || retention < 1 {
+		return 7
+	}
+	return retention
+}
+
+// GetAuditRetentionDays returns how long audit entries are kept, 0 to keep them forever.
+func GetAuditRetentionDays() int {
+	retention, err := strconv.Atoi(os.Getenv("AUDIT_RETENTION_DAYS"))
+	if err != nil || retention < 0 {
+		return 0
+	}
+	return retention
+}
+
+// GetIdempotencyWindow returns how long the responses of requests sent with an
+// Idempotency-Key are kept for replay.
+func GetIdempotencyWindow() time.Duration {
+	window, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_WINDOW"))
+	if err != nil || window <= 0 {
+		return 24 * time.Hour
+	}
+	return window
+}
+
+// GetTTLSweepInterval returns how often the records of the collections with a ttl are checked
+// for expiry.
+func GetTTLSweepInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("TTL_SWEEP_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return time.Minute
+	}
+	return interval
+}
+
+// GetSlowQueryThreshold returns the duration over which the queries of the list and
+// aggregate endpoints are written to the slow query log.
+func GetSlowQueryThreshold() time.Duration {
+	threshold, err := time.ParseDuration(os.Getenv("SLOW_QUERY_THRESHOLD"))
+	if err != nil || threshold <= 0 {
+		return 500 * time.Millisecond
+	}
+	return threshold
+}
+
+// GetEncryptionKey returns the base64 encoded 32 bytes key encrypting the fields marked
+// "encrypted" in the schemas.
+func GetEncryptionKey() string {
+	return os.Getenv("ENCRYPTION_KEY")
+}
+
+// GetPreviousEncryptionKeys returns the keys replaced by ENCRYPTION_KEY, which are still
+// needed to read the values encrypted before a rotation.
+func GetPreviousEncryptionKeys() []string {
+	var keys []string
+	for _, key := range strings.Split(os.Getenv("ENCRYPTION_PREVIOUS_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
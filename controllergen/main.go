@@ -18,59 +18,34 @@ import (
 	"github.com/lodjim/naboobase/models"
 )
 
+// {{.ConfigName}} is shared by the handlers and the registry of the {{.Collection}} collection
+var {{.ConfigName}} = core.HandlerConfig{
+	NewRequest:    func() interface{} { return &models.{{.Model}}Request{} },
+	NewModel:      func() interface{} { return &models.{{.Model}}{} },
+	NewResponse:   func() interface{} { return &models.{{.Model}}Response{} },
+	Functionality: "{{.Collection}}",
+	Collection:    "{{.Collection}}",
+	Preprocess:    nil,
+}
+
 // Create{{.Model}} creates a new {{.Model}} in the database
 func Create{{.Model}}(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateCreateHandler(db, core.HandlerConfig{
-		NewRequest:  func() interface{} { return &models.{{.Model}}Request{} },
-		NewModel:    func() interface{} { return &models.{{.Model}}{} },
-		NewResponse: func() interface{} { return &models.{{.Model}}Response{} },
-		Functionality: "{{.Collection}}",
-		Collection:  "{{.Collection}}",
-		Preprocess:  nil,
-	})
+	return core.GenerateCreateHandler(db, {{.ConfigName}})
 }
 
 func GetOne{{.Model}}(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateGetOneHandler(db, core.HandlerConfig{
-		NewRequest:  func() interface{} { return &models.{{.Model}}Request{} },
-		NewModel:    func() interface{} { return &models.{{.Model}}{} },
-		NewResponse: func() interface{} { return &models.{{.Model}}Response{} },
-		Functionality: "{{.Collection}}",
-		Collection:  "{{.Collection}}",
-		Preprocess:  nil,
-	})
+	return core.GenerateGetOneHandler(db, {{.ConfigName}})
 }
 func GetAll{{.Model}}(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateGetAllHandler(db, core.HandlerConfig{
-		NewRequest:  func() interface{} { return &models.{{.Model}}Request{} },
-		NewModel:    func() interface{} { return &models.{{.Model}}{} },
-		NewResponse: func() interface{} { return &models.{{.Model}}Response{} },
-		Functionality: "{{.Collection}}",
-		Collection:  "{{.Collection}}",
-		Preprocess:  nil,
-	})
+	return core.GenerateGetAllHandler(db, {{.ConfigName}})
 }
 
 func Update{{.Model}}(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateUpdateHandler(db, core.HandlerConfig{
-			NewRequest:  func() interface{} { return &models.{{.Model}}Request{} },
-			NewModel:    func() interface{} { return &models.{{.Model}}{} },
-			NewResponse: func() interface{} { return &models.{{.Model}}Response{} },
-			Functionality: "{{.Collection}}",
-			Collection:  "{{.Collection}}",
-			Preprocess:  nil,
-	})
+	return core.GenerateUpdateHandler(db, {{.ConfigName}})
 }
 
 func Delete{{.Model}}(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateDeleteHandler(db, core.HandlerConfig{
-			NewRequest:  func() interface{} { return &models.{{.Model}}Request{} },
-			NewModel:    func() interface{} { return &models.{{.Model}}{} },
-			NewResponse: func() interface{} { return &models.{{.Model}}Response{} },
-			Functionality: "{{.Collection}}",
-			Collection:  "{{.Collection}}",
-			Preprocess:  nil,
-	})
+	return core.GenerateDeleteHandler(db, {{.ConfigName}})
 }
 
 
@@ -80,12 +55,14 @@ func init() {
 	core.AutoEndpointFuncRegistry["{{.Collection}}-GET"] = GetAll{{.Model}}
 	core.AutoEndpointFuncRegistry["{{.Collection}}-PUT-ID"] = Update{{.Model}}
 	core.AutoEndpointFuncRegistry["{{.Collection}}-DELETE-ID"] = Delete{{.Model}}
+	core.HandlerConfigRegistry["{{.Collection}}"] = {{.ConfigName}}
 }
 `
 
 type ControllerConfig struct {
 	Model      string
 	Collection string
+	ConfigName string // The variable holding the HandlerConfig of the collection
 }
 
 func generateControllerFile(config ControllerConfig) error {
@@ -134,6 +111,7 @@ func main() {
 			Model:      utils.ConvertToCamelCase(base),
 			Collection: base,
 		}
+		config.ConfigName = strings.ToLower(config.Model[:1]) + config.Model[1:] + "HandlerConfig"
 		err := generateControllerFile(config)
 		if err != nil {
 			fmt.Printf("Error generating controller: %v\n", err)
@@ -6,59 +6,34 @@ import (
 	"github.com/lodjim/naboobase/models"
 )
 
+// translationHandlerConfig is shared by the handlers and the registry of the translation collection
+var translationHandlerConfig = core.HandlerConfig{
+	NewRequest:    func() interface{} { return &models.TranslationRequest{} },
+	NewModel:      func() interface{} { return &models.Translation{} },
+	NewResponse:   func() interface{} { return &models.TranslationResponse{} },
+	Functionality: "translation",
+	Collection:    "translation",
+	Preprocess:    nil,
+}
+
 // CreateTranslation creates a new Translation in the database
 func CreateTranslation(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateCreateHandler(db, core.HandlerConfig{
-		NewRequest:  func() interface{} { return &models.TranslationRequest{} },
-		NewModel:    func() interface{} { return &models.Translation{} },
-		NewResponse: func() interface{} { return &models.TranslationResponse{} },
-		Functionality: "translation",
-		Collection:  "translation",
-		Preprocess:  nil,
-	})
+	return core.GenerateCreateHandler(db, translationHandlerConfig)
 }
 
 func GetOneTranslation(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateGetOneHandler(db, core.HandlerConfig{
-		NewRequest:  func() interface{} { return &models.TranslationRequest{} },
-		NewModel:    func() interface{} { return &models.Translation{} },
-		NewResponse: func() interface{} { return &models.TranslationResponse{} },
-		Functionality: "translation",
-		Collection:  "translation",
-		Preprocess:  nil,
-	})
+	return core.GenerateGetOneHandler(db, translationHandlerConfig)
 }
 func GetAllTranslation(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateGetAllHandler(db, core.HandlerConfig{
-		NewRequest:  func() interface{} { return &models.TranslationRequest{} },
-		NewModel:    func() interface{} { return &models.Translation{} },
-		NewResponse: func() interface{} { return &models.TranslationResponse{} },
-		Functionality: "translation",
-		Collection:  "translation",
-		Preprocess:  nil,
-	})
+	return core.GenerateGetAllHandler(db, translationHandlerConfig)
 }
 
 func UpdateTranslation(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateUpdateHandler(db, core.HandlerConfig{
-			NewRequest:  func() interface{} { return &models.TranslationRequest{} },
-			NewModel:    func() interface{} { return &models.Translation{} },
-			NewResponse: func() interface{} { return &models.TranslationResponse{} },
-			Functionality: "translation",
-			Collection:  "translation",
-			Preprocess:  nil,
-	})
+	return core.GenerateUpdateHandler(db, translationHandlerConfig)
 }
 
 func DeleteTranslation(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateDeleteHandler(db, core.HandlerConfig{
-			NewRequest:  func() interface{} { return &models.TranslationRequest{} },
-			NewModel:    func() interface{} { return &models.Translation{} },
-			NewResponse: func() interface{} { return &models.TranslationResponse{} },
-			Functionality: "translation",
-			Collection:  "translation",
-			Preprocess:  nil,
-	})
+	return core.GenerateDeleteHandler(db, translationHandlerConfig)
 }
 
 
@@ -68,4 +43,5 @@ func init() {
 	core.AutoEndpointFuncRegistry["translation-GET"] = GetAllTranslation
 	core.AutoEndpointFuncRegistry["translation-PUT-ID"] = UpdateTranslation
 	core.AutoEndpointFuncRegistry["translation-DELETE-ID"] = DeleteTranslation
+	core.HandlerConfigRegistry["translation"] = translationHandlerConfig
 }
@@ -6,59 +6,34 @@ import (
 	"github.com/lodjim/naboobase/models"
 )
 
+// volunterHandlerConfig is shared by the handlers and the registry of the volunter collection
+var volunterHandlerConfig = core.HandlerConfig{
+	NewRequest:    func() interface{} { return &models.VolunterRequest{} },
+	NewModel:      func() interface{} { return &models.Volunter{} },
+	NewResponse:   func() interface{} { return &models.VolunterResponse{} },
+	Functionality: "volunter",
+	Collection:    "volunter",
+	Preprocess:    nil,
+}
+
 // CreateVolunter creates a new Volunter in the database
 func CreateVolunter(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateCreateHandler(db, core.HandlerConfig{
-		NewRequest:  func() interface{} { return &models.VolunterRequest{} },
-		NewModel:    func() interface{} { return &models.Volunter{} },
-		NewResponse: func() interface{} { return &models.VolunterResponse{} },
-		Functionality: "volunter",
-		Collection:  "volunter",
-		Preprocess:  nil,
-	})
+	return core.GenerateCreateHandler(db, volunterHandlerConfig)
 }
 
 func GetOneVolunter(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateGetOneHandler(db, core.HandlerConfig{
-		NewRequest:  func() interface{} { return &models.VolunterRequest{} },
-		NewModel:    func() interface{} { return &models.Volunter{} },
-		NewResponse: func() interface{} { return &models.VolunterResponse{} },
-		Functionality: "volunter",
-		Collection:  "volunter",
-		Preprocess:  nil,
-	})
+	return core.GenerateGetOneHandler(db, volunterHandlerConfig)
 }
 func GetAllVolunter(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateGetAllHandler(db, core.HandlerConfig{
-		NewRequest:  func() interface{} { return &models.VolunterRequest{} },
-		NewModel:    func() interface{} { return &models.Volunter{} },
-		NewResponse: func() interface{} { return &models.VolunterResponse{} },
-		Functionality: "volunter",
-		Collection:  "volunter",
-		Preprocess:  nil,
-	})
+	return core.GenerateGetAllHandler(db, volunterHandlerConfig)
 }
 
 func UpdateVolunter(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateUpdateHandler(db, core.HandlerConfig{
-			NewRequest:  func() interface{} { return &models.VolunterRequest{} },
-			NewModel:    func() interface{} { return &models.Volunter{} },
-			NewResponse: func() interface{} { return &models.VolunterResponse{} },
-			Functionality: "volunter",
-			Collection:  "volunter",
-			Preprocess:  nil,
-	})
+	return core.GenerateUpdateHandler(db, volunterHandlerConfig)
 }
 
 func DeleteVolunter(db core.MongoDBconnector) gin.HandlerFunc {
-	return core.GenerateDeleteHandler(db, core.HandlerConfig{
-			NewRequest:  func() interface{} { return &models.VolunterRequest{} },
-			NewModel:    func() interface{} { return &models.Volunter{} },
-			NewResponse: func() interface{} { return &models.VolunterResponse{} },
-			Functionality: "volunter",
-			Collection:  "volunter",
-			Preprocess:  nil,
-	})
+	return core.GenerateDeleteHandler(db, volunterHandlerConfig)
 }
 
 
@@ -68,4 +43,5 @@ func init() {
 	core.AutoEndpointFuncRegistry["volunter-GET"] = GetAllVolunter
 	core.AutoEndpointFuncRegistry["volunter-PUT-ID"] = UpdateVolunter
 	core.AutoEndpointFuncRegistry["volunter-DELETE-ID"] = DeleteVolunter
+	core.HandlerConfigRegistry["volunter"] = volunterHandlerConfig
 }
@@ -0,0 +1,155 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var aggregateOperators = map[string]string{
+	"sum": "$sum",
+	"avg": "$avg",
+	"min": "$min",
+	"max": "$max",
+}
+
+// buildGroupStage turns the group_by and metrics query parameters into a $group stage.
+// Metrics are written as count, sum:field, avg:field, min:field or max:field.
+func buildGroupStage(schema *CollectionSchema, superuser bool, groupBy string, metrics string) (bson.M, []string, error) {
+	groupId := bson.M{}
+	var groupFields []string
+	for _, field := range strings.Split(groupBy, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		definition, ok := schema.Field(field)
+		if !ok || !isVisible(definition, superuser) {
+			return nil, nil, fmt.Errorf("unknown group_by field: %s", field)
+		}
+		if definition.Encryption != "" {
+			return nil, nil, fmt.Errorf("the encrypted field %s can't be grouped on", field)
+		}
+		groupId[field] = "$" + field
+		groupFields = append(groupFields, field)
+	}
+
+	group := bson.M{}
+	if len(groupFields) != 0 {
+		group["_id"] = groupId
+	} else {
+		group["_id"] = nil
+	}
+
+	if metrics == "" {
+		metrics = "count"
+	}
+	for _, metric := range strings.Split(metrics, ",") {
+		metric = strings.TrimSpace(metric)
+		if metric == "count" {
+			group["count"] = bson.M{"$sum": 1}
+			continue
+		}
+		parts := strings.SplitN(metric, ":", 2)
+		operator, ok := aggregateOperators[parts[0]]
+		if !ok || len(parts) != 2 {
+			return nil, nil, fmt.Errorf("unsupported metric: %s", metric)
+		}
+		field, ok := schema.Field(parts[1])
+		if !ok || !isVisible(field, superuser) {
+			return nil, nil, fmt.Errorf("unknown metric field: %s", parts[1])
+		}
+		if field.Encryption != "" {
+			return nil, nil, fmt.Errorf("the encrypted field %s can't be aggregated", parts[1])
+		}
+		if parts[0] != "min" && parts[0] != "max" && !isNumericType(field.Type) {
+			return nil, nil, fmt.Errorf("the %s metric requires a numeric field, %s is %s", parts[0], parts[1], field.Type)
+		}
+		group[fmt.Sprintf("%s_%s", parts[0], strings.ReplaceAll(parts[1], ".", "_"))] = bson.M{operator: "$" + parts[1]}
+	}
+	return group, groupFields, nil
+}
+
+func GenerateAggregateHandler(db MongoDBconnector, config HandlerConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var modelConfig ModelConfig
+		if err := loadConfig(config.Collection, &modelConfig); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		if _, ok := authorizeRequest(c, modelConfig.ContentConfigs.GetAll.AuthRules); !ok {
+			return
+		}
+		schema, err := loadSchema(config.Collection)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		filter := bson.M{}
+		if filterSearch := c.Query("filter"); filterSearch != "" {
+			query, err := compileRequestFilter(c, config.Collection, filterSearch)
+			if err != nil {
+				c.String(http.StatusBadRequest, "The filter used is not appropriate: "+err.Error())
+				return
+			}
+			filter = query
+		}
+		joins, filter, err := filterJoins(c, config.Collection, filter)
+		if err != nil {
+			c.String(http.StatusBadRequest, "The filter used is not appropriate: "+err.Error())
+			return
+		}
+		filter, err = encryptFilter(config.Collection, filter)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		group, groupFields, err := buildGroupStage(schema, requestIsSuperUser(c), c.Query("group_by"), c.Query("metrics"))
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		pipeline := append(joins,
+			bson.M{"$match": filter},
+			bson.M{"$group": group},
+			bson.M{"$sort": bson.M{"_id": 1}},
+		)
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+		defer cancel()
+		var results []bson.M
+		started := time.Now()
+		if err := db.Aggregate(ctx, config.Collection, pipeline, &results); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		logSlowQuery(c, db, config.Collection, "aggregate", bson.M{"pipeline": pipeline}, started)
+
+		data := make([]bson.M, 0, len(results))
+		for _, result := range results {
+			row := bson.M{}
+			if keys, ok := result["_id"].(bson.M); ok {
+				for _, field := range groupFields {
+					row[field] = keys[field]
+				}
+			}
+			for key, value := range result {
+				if key != "_id" {
+					row[key] = value
+				}
+			}
+			data = append(data, row)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"total": len(data),
+			"data":  data,
+		})
+	}
+}
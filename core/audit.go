@@ -0,0 +1,215 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lodjim/naboobase/configs"
+	"github.com/lodjim/naboobase/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const auditCollection = "_audit"
+
+const auditRetentionIndexName = "audit_retention"
+
+const redactedValue = "[redacted]"
+
+type AuditChange struct {
+	Field  string      `json:"field" bson:"field"`
+	Before interface{} `json:"before" bson:"before"`
+	After  interface{} `json:"after" bson:"after"`
+}
+
+type AuditEntry struct {
+	Id         primitive.ObjectID `json:"_id" bson:"_id" db:"autogenerate"`
+	ActorId    string             `json:"actor_id" bson:"actor_id"`
+	ActorEmail string             `json:"actor_email" bson:"actor_email"`
+	IP         string             `json:"ip" bson:"ip"`
+	RequestId  string             `json:"request_id" bson:"request_id"`
+	Collection string             `json:"collection" bson:"collection"`
+	RecordId   string             `json:"record_id" bson:"record_id"`
+	Operation  string             `json:"operation" bson:"operation"`
+	Changes    []AuditChange      `json:"changes" bson:"changes"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// isSensitiveField tells whether the values of a field must stay out of the audit log.
+func isSensitiveField(field string) bool {
+	return strings.Contains(strings.ToLower(field), "password")
+}
+
+// redactedFields returns the fields of a collection whose values stay out of the audit log,
+// the encrypted ones and the ones no client can read.
+func redactedFields(collection string) (map[string]bool, error) {
+	encrypted, err := encryptedFields(collection)
+	if err != nil {
+		return nil, err
+	}
+	redacted, err := invisibleFields(collection, true)
+	if err != nil {
+		return nil, err
+	}
+	for name := range encrypted {
+		if redacted == nil {
+			redacted = make(map[string]bool)
+		}
+		redacted[name] = true
+	}
+	return redacted, nil
+}
+
+// diffDocuments lists the fields whose value differs between two versions of a record. The
+// values of the redacted fields, besides the sensitive ones, are hidden.
+func diffDocuments(before, after bson.M, redacted map[string]bool) []AuditChange {
+	fields := make(map[string]bool)
+	for field := range before {
+		fields[field] = true
+	}
+	for field := range after {
+		fields[field] = true
+	}
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	changes := make([]AuditChange, 0)
+	for _, field := range names {
+		oldValue, newValue := before[field], after[field]
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		if redacted[field] || isSensitiveField(field) {
+			if oldValue != nil {
+				oldValue = redactedValue
+			}
+			if newValue != nil {
+				newValue = redactedValue
+			}
+		}
+		changes = append(changes, AuditChange{Field: field, Before: oldValue, After: newValue})
+	}
+	return changes
+}
+
+// writeAudit stores the audit entry of a change.
+func writeAudit(ctx context.Context, db MongoDBconnector, change RecordChange) error {
+	redacted, err := redactedFields(change.Collection)
+	if err != nil {
+		// Without them the values of the change can't be written
+		return fmt.Errorf("writing the audit entry: %w", err)
+	}
+	entry := &AuditEntry{
+		ActorId:    change.Actor.Id,
+		ActorEmail: change.Actor.Email,
+		IP:         change.Actor.IP,
+		RequestId:  change.Actor.RequestId,
+		Collection: change.Collection,
+		RecordId:   change.RecordId,
+		Operation:  change.Operation,
+		Changes:    diffDocuments(change.Before, change.After, redacted),
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := db.CreateRecord(ctx, auditCollection, entry); err != nil {
+		return fmt.Errorf("writing the audit entry: %w", err)
+	}
+	return nil
+}
+
+// ensureAuditIndexes indexes the audit log by record and expires it after the retention
+// period configured by AUDIT_RETENTION_DAYS, if any.
+func ensureAuditIndexes(ctx context.Context, db MongoDBconnector) error {
+	byRecord := mongo.IndexModel{Keys: bson.D{{Key: "collection", Value: 1}, {Key: "record_id", Value: 1}}}
+	if err := db.EnsureIndexes(ctx, auditCollection, byRecord); err != nil {
+		return err
+	}
+	retention := configs.GetAuditRetentionDays()
+	if retention <= 0 {
+		// Ignore the error, there may be no retention index to drop
+		_ = db.DropIndex(ctx, auditCollection, auditRetentionIndexName)
+		return nil
+	}
+	expiry := mongo.IndexModel{
+		Keys: bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().
+			SetName(auditRetentionIndexName).
+			SetExpireAfterSeconds(int32(retention * 24 * 60 * 60)),
+	}
+	if err := db.EnsureIndexes(ctx, auditCollection, expiry); err != nil {
+		// The retention period changed since the index was created, rebuild it
+		if dropErr := db.DropIndex(ctx, auditCollection, auditRetentionIndexName); dropErr != nil {
+			return err
+		}
+		return db.EnsureIndexes(ctx, auditCollection, expiry)
+	}
+	return nil
+}
+
+type AuditManagement struct {
+}
+
+func (auditManagement *AuditManagement) GetAuditEntries(db MongoDBconnector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := authorizeRequest(c, AuthRules{ShouldBeAuthenticated: true, OnlyForAdmin: true}); !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+		defer cancel()
+
+		filter := bson.M{}
+		if filterSearch := c.Query("filter"); filterSearch != "" {
+			query, err := utils.TransformFilterToMongoQuery(filterSearch)
+			if err != nil {
+				c.String(http.StatusBadRequest, "The filter used is not appropriate: "+err.Error())
+				return
+			}
+			filter = query
+		}
+
+		page, _ := strconv.ParseInt(c.Query("page"), 10, 64)
+		if page < 1 {
+			page = 1
+		}
+		limit, _ := strconv.ParseInt(c.Query("limit"), 10, 64)
+		if limit < 1 {
+			limit = 50
+		}
+		if limit > 1000 {
+			limit = 1000
+		}
+
+		var results []map[string]interface{}
+		sort := bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}
+		total, err := db.GetPaginatedRecords(ctx, auditCollection, filter, page, limit, sort, nil, &results)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"total": total,
+			"data":  results,
+		})
+	}
+}
+
+func (auditManagement *AuditManagement) Init(db MongoDBconnector) []Endpoint {
+	var endpoints []Endpoint = []Endpoint{{
+		Method:  "GET",
+		Path:    "/admin/audit",
+		Handler: auditManagement.GetAuditEntries(db),
+	},
+	}
+	return endpoints
+}
@@ -292,7 +292,7 @@ func (tpa *ThirdPartAuthenticator) CallBackAuth(db MongoDBconnector) gin.Handler
 			}
 		}
 
-		token, err := utils.CreateToken(user.Email, user.Id.Hex(), user.IsVerified, user.IsSuperuser)
+		token, err := utils.CreateToken(user.Email, user.Id.Hex(), user.Role, user.IsVerified, user.IsSuperuser)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "token creation failed"})
 			return
@@ -3,6 +3,7 @@ package core
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -31,13 +32,25 @@ type CRUDConfig struct {
 	AuthRules AuthRules `json:"auth_rules"`
 }
 
+type BulkConfig struct {
+	Enabled    bool  `json:"enabled"`
+	MaxRecords int64 `json:"max_records"`
+}
+
 type ContentConfig struct {
-	ForeignKeys []ForeignKeyConfig `json:"foreign_keys"`
-	Create      CRUDConfig         `json:"create"`
-	Delete      CRUDConfig         `json:"delete"`
-	Update      CRUDConfig         `json:"update"`
-	GetOne      CRUDConfig         `json:"getOne"`
-	GetAll      CRUDConfig         `json:"getAll"`
+	ForeignKeys    []ForeignKeyConfig `json:"foreign_keys"`
+	Bulk           BulkConfig         `json:"bulk"`
+	Cache          CacheConfig        `json:"cache"`
+	TTL            TTLConfig          `json:"ttl"`
+	History        bool               `json:"history"`
+	Search         []string           `json:"search"`
+	DefaultSort    string             `json:"default_sort"`
+	SearchLanguage string             `json:"search_language"`
+	Create         CRUDConfig         `json:"create"`
+	Delete         CRUDConfig         `json:"delete"`
+	Update         CRUDConfig         `json:"update"`
+	GetOne         CRUDConfig         `json:"getOne"`
+	GetAll         CRUDConfig         `json:"getAll"`
 }
 
 type ModelConfig struct {
@@ -64,6 +77,159 @@ func loadConfig(collectionName string, modelConfig *ModelConfig) error {
 	return nil
 }
 
+// checkAuthRules applies the auth rules of an operation to claims that were already verified.
+func checkAuthRules(rules AuthRules, claims *utils.Claims) (int, error) {
+	if !rules.ShouldBeAuthenticated && !rules.OnlyForAdmin {
+		return http.StatusOK, nil
+	}
+	if claims == nil || claims.Id == "" {
+		return http.StatusUnauthorized, errors.New("Unauthorized: authentication required")
+	}
+	if rules.OnlyForAdmin && !claims.IsSuperUser {
+		return http.StatusUnauthorized, errors.New("You are not admin")
+	}
+	return http.StatusOK, nil
+}
+
+// authorizeRequest verifies the bearer token of the request, if any, against the auth rules.
+// The response is written when the request is rejected.
+func authorizeRequest(c *gin.Context, rules AuthRules) (*utils.Claims, bool) {
+	claims, err := utils.GetClaims(c)
+	if err != nil {
+		c.String(http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %s", err.Error()))
+		return nil, false
+	}
+	if status, err := checkAuthRules(rules, claims); err != nil {
+		c.String(status, err.Error())
+		return nil, false
+	}
+	c.Set("claims", claims)
+	return claims, true
+}
+
+// prepareCreate validates a create payload and turns it into a model ready to be inserted.
+func prepareCreate(config HandlerConfig, modelConfig ModelConfig, claims *utils.Claims, payload []byte) (interface{}, int, error) {
+	req := config.NewRequest()
+	model := config.NewModel()
+
+	schema, err := loadSchema(config.Collection)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(payload, &values); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := checkReadOnly(schema, values); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	defaults, err := defaultValues(schema, claims, values)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	for name, value := range defaults {
+		values[name] = value
+	}
+	if payload, err = json.Marshal(values); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if err := json.Unmarshal(payload, req); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if err := validate.Struct(req); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok {
+			return nil, http.StatusBadRequest, validationErrors
+		}
+		return nil, http.StatusBadRequest, errors.New("Invalid request payload")
+	}
+
+	// Copy data from request to model using copier
+	if err := copier.Copy(model, req); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	// The request struct doesn't declare every field that has a default
+	for name, value := range defaults {
+		if _, err := utils.Get(utils.ToGoFieldName(name), req); err == nil {
+			continue
+		}
+		if err := setModelField(model, utils.ToGoFieldName(name), value); err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("the default of %s doesn't fit the field: %w", name, err)
+		}
+	}
+
+	if config.Collection != "user" {
+		for _, relations := range modelConfig.ContentConfigs.ForeignKeys {
+			if relations.Model == "user" {
+				if claims == nil {
+					return nil, http.StatusInternalServerError, errors.New("Can't get the ID of the user")
+				}
+				setOwner(model, relations, claims.Id)
+			}
+		}
+	}
+
+	// Execute custom preprocessing (e.g., password hashing)
+	if config.Preprocess != nil {
+		if err := config.Preprocess(model, req, nil); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+	if err := computeStoredFields(config.Collection, model); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return model, http.StatusOK, nil
+}
+
+// setOwner points a foreign key of the model to the user creating it. Foreign keys are named
+// by their JSON key, as in the schema, while the model field has the Go name generated from it.
+func setOwner(model interface{}, relations ForeignKeyConfig, userId string) {
+	utils.Set(utils.ToGoFieldName(relations.Name), userId, model)
+}
+
+// prepareUpdate decodes an update payload and checks that every key belongs to the model.
+func prepareUpdate(config HandlerConfig, payload []byte) (map[string]interface{}, int, error) {
+	var data map[string]interface{}
+	var modelJson map[string]interface{}
+	jsonBytes, err := json.Marshal(config.NewModel())
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("Invalid JSON")
+	}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil, http.StatusBadRequest, errors.New("Invalid JSON")
+	}
+	if err = json.Unmarshal(jsonBytes, &modelJson); err != nil {
+		return nil, http.StatusBadRequest, errors.New("Invalid JSON")
+	}
+	if err := utils.ValidateKeys(data, modelJson); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	schema, err := loadSchema(config.Collection)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if err := checkComputedWrite(schema, data); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := checkReadOnly(schema, data); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return data, http.StatusOK, nil
+}
+
+// recordId returns the hexadecimal ID of a model, or an empty string when it has none.
+func recordId(record interface{}) string {
+	value, err := utils.Get("Id", record)
+	if err != nil {
+		return ""
+	}
+	if id, ok := value.(primitive.ObjectID); ok {
+		return id.Hex()
+	}
+	return fmt.Sprintf("%v", value)
+}
+
 func GenerateCreateHandler(db MongoDBconnector, config HandlerConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var claims *utils.Claims
@@ -93,52 +259,24 @@ func GenerateCreateHandler(db MongoDBconnector, config HandlerConfig) gin.Handle
 		}
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		req := config.NewRequest()
-		model := config.NewModel()
 		res := config.NewResponse()
 
-		if err := c.BindJSON(req); err != nil {
+		rawData, err := c.GetRawData()
+		if err != nil {
 			c.String(http.StatusBadRequest, err.Error())
 			return
 		}
-
-		if err := validate.Struct(req); err != nil {
-			if validationErrors, ok := err.(validator.ValidationErrors); ok {
-				c.String(http.StatusBadRequest, validationErrors.Error())
-			} else {
-				c.String(http.StatusBadRequest, "Invalid request payload")
-			}
-			return
-		}
-
-		if config.Collection != "user" {
-			for _, relations := range modelConfig.ContentConfigs.ForeignKeys {
-				if relations.Model == "user" {
-					if !ok {
-						c.String(http.StatusInternalServerError, "Can't get the ID of the user")
-						return
-					}
-					claims = got_claims.(*utils.Claims)
-					utils.Set(relations.Name, claims.Id, &model)
-				}
-			}
+		if ok {
+			claims = got_claims.(*utils.Claims)
 		}
-		// Copy data from request to model using copier
-		if err := copier.Copy(model, req); err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
+		model, status, err := prepareCreate(config, modelConfig, claims, rawData)
+		if err != nil {
+			c.String(status, err.Error())
 			return
 		}
 
-		// Execute custom preprocessing (e.g., password hashing)
-		if config.Preprocess != nil {
-			if err := config.Preprocess(model, req, nil); err != nil {
-				c.String(http.StatusInternalServerError, err.Error())
-				return
-			}
-		}
-
 		// Insert the model into the database
-		if err := db.CreateRecord(ctx, config.Collection, model); err != nil {
+		if err := createRecord(ctx, db, config.Collection, actorFromRequest(c), model); err != nil {
 			c.String(http.StatusBadRequest, "Failed to create record: "+err.Error())
 			return
 		}
@@ -148,9 +286,14 @@ func GenerateCreateHandler(db MongoDBconnector, config HandlerConfig) gin.Handle
 			c.String(http.StatusInternalServerError, err.Error())
 			return
 		}
+		rendered, err := renderVisible(config.Collection, requestIsSuperUser(c), res)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
 
 		// Return the response as JSON
-		c.JSON(http.StatusOK, res)
+		c.JSON(http.StatusOK, rendered)
 	}
 }
 
@@ -177,7 +320,12 @@ func GenerateGetHandler(db MongoDBconnector, config HandlerConfig) gin.HandlerFu
 			c.String(http.StatusBadRequest, "Failed to get the record: "+err.Error())
 			return
 		}
-		c.JSON(http.StatusOK, res)
+		rendered, err := renderVisible(config.Collection, requestIsSuperUser(c), res)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, rendered)
 	}
 }
 
@@ -215,18 +363,28 @@ func GenerateGetOneHandler(db MongoDBconnector, config HandlerConfig) gin.Handle
 			return
 		}
 		model := config.NewModel()
-		res := config.NewModel()
 		if config.Preprocess != nil {
 			if err := config.Preprocess(model, req, nil); err != nil {
 				c.String(http.StatusInternalServerError, err.Error())
 				return
 			}
 		}
-		err = db.GetRecord(ctx, config.Collection, bson.M{"_id": req}, res)
+		res, err := cachedRead(ctx, config.Collection, modelConfig.ContentConfigs.Cache, recordCacheKey(id), func(ctx context.Context) (interface{}, error) {
+			res := config.NewModel()
+			return res, db.GetRecord(ctx, config.Collection, bson.M{"_id": req}, res)
+		})
 		if err != nil {
 			c.String(http.StatusBadRequest, "Failed to get the record: "+err.Error())
 			return
 		}
+		withComputed, err := modelWithComputedFields(config.Collection, res)
+		if err == nil {
+			res, err = renderVisible(config.Collection, requestIsSuperUser(c), withComputed)
+		}
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
 		c.JSON(http.StatusOK, res)
 	}
 }
@@ -273,7 +431,7 @@ func GenerateDeleteHandler(db MongoDBconnector, config HandlerConfig) gin.Handle
 				return
 			}
 		}
-		err = db.DeleteRecordById(ctx, config.Collection, req, res)
+		err = deleteRecord(ctx, db, config.Collection, actorFromRequest(c), req, res)
 		if err != nil {
 			c.String(http.StatusBadRequest, "Failed to delete the record: "+err.Error())
 			return
@@ -314,36 +472,27 @@ func GenerateUpdateHandler(db MongoDBconnector, config HandlerConfig) gin.Handle
 		model := config.NewModel()
 		id := c.Param("id")
 		req, err := primitive.ObjectIDFromHex(id)
-		rawData, err := c.GetRawData()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to read request body"})
+			c.String(http.StatusBadRequest, err.Error())
 			return
 		}
-		var data map[string]interface{}
-		var modelJson map[string]interface{}
-		jsonBytes, err := json.Marshal(model)
+		rawData, err := c.GetRawData()
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid JSON"})
-			return
-		}
-		if err := json.Unmarshal(rawData, &data); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to read request body"})
 			return
 		}
-		if err = json.Unmarshal(jsonBytes, &modelJson); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		data, status, err := prepareUpdate(config, rawData)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
 			return
 		}
-		if err := utils.ValidateKeys(data, modelJson); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		}
 		if config.Preprocess != nil {
 			if err := config.Preprocess(model, req, nil); err != nil {
 				c.String(http.StatusInternalServerError, err.Error())
 				return
 			}
 		}
-		err = db.UpdateRecord(ctx, config.Collection, req, data, model)
+		err = updateRecord(ctx, db, config.Collection, actorFromRequest(c), req, data, model)
 		if err != nil {
 			c.String(http.StatusBadRequest, "Failed to update the record: "+err.Error())
 			return
@@ -385,9 +534,9 @@ func GenerateGetAllHandler(db MongoDBconnector, config HandlerConfig) gin.Handle
 
 		var filter *bson.M
 		if filter_search != "" {
-			query, err := utils.TransformFilterToMongoQuery(filter_search)
+			query, err := compileRequestFilter(c, config.Collection, filter_search)
 			if err != nil {
-				c.String(http.StatusBadRequest, "The filter used is not appropriate")
+				c.String(http.StatusBadRequest, "The filter used is not appropriate: "+err.Error())
 				return
 			}
 			filter = &query
@@ -396,6 +545,16 @@ func GenerateGetAllHandler(db MongoDBconnector, config HandlerConfig) gin.Handle
 			filter = &emptyQuery
 		}
 
+		search := c.Query("q")
+		if search != "" {
+			text, err := searchFilter(modelConfig, search)
+			if err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			(*filter)["$text"] = text
+		}
+
 		page, _ := strconv.ParseInt(c.Query("page"), 10, 64)
 		if page < 1 {
 			page = 1
@@ -409,14 +568,35 @@ func GenerateGetAllHandler(db MongoDBconnector, config HandlerConfig) gin.Handle
 			limit = 10000
 		}
 
-		sortOrder, _ := strconv.Atoi(c.Query("sort_order"))
-		if sortOrder != 1 && sortOrder != -1 {
-			sortOrder = -1
+		sortExpression := c.Query("sort")
+		if sortExpression == "" && (c.Query("sort_field") != "" || c.Query("sort_order") != "") {
+			sortExpression = legacySort(c.Query("sort_field"), c.Query("sort_order"))
+		}
+		if sortExpression == "" {
+			sortExpression = modelConfig.ContentConfigs.DefaultSort
+		}
+		if sortExpression == "" {
+			sortExpression = fallbackSort
+		}
+		sort, err := parseSort(config.Collection, requestIsSuperUser(c), search != "", sortExpression)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
 		}
 
-		sortField := c.Query("sort_field")
-		if sortField == "" {
-			sortField = "_id"
+		var projection bson.M
+		if search != "" {
+			projection = bson.M{searchScoreField: bson.M{"$meta": "textScore"}}
+		}
+
+		schema, err := loadSchema(config.Collection)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := checkComputedQuery(schema, *filter); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
 		}
 
 		req := config.NewRequest()
@@ -433,22 +613,83 @@ func GenerateGetAllHandler(db MongoDBconnector, config HandlerConfig) gin.Handle
 			}
 		}
 		response := config.NewResponse()
-		var results []map[string]interface{}
-		total, err := db.GetPaginatedRecords(ctx, config.Collection, *filter, page, limit, sortField, sortOrder, &results)
+		invisible, err := invisibleFields(config.Collection, requestIsSuperUser(c))
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		withDistance := c.Query("distance") == "true"
+		joins, joined, err := filterJoins(c, config.Collection, *filter)
+		if err != nil {
+			c.String(http.StatusBadRequest, "The filter used is not appropriate: "+err.Error())
+			return
+		}
+		cacheConfig := modelConfig.ContentConfigs.Cache
+		if joins != nil {
+			if withDistance || search != "" {
+				c.String(http.StatusBadRequest, "Filters on related records can't be combined with a search or distances")
+				return
+			}
+			// Changes to the related records don't invalidate the cache of the collection
+			cacheConfig = CacheConfig{}
+		}
+		if c.Query("explain") == "true" {
+			if !requestIsSuperUser(c) {
+				c.String(http.StatusUnauthorized, "You are not admin")
+				return
+			}
+			if withDistance {
+				c.String(http.StatusBadRequest, "Queries with distances can't be explained")
+				return
+			}
+			explainList(c, db, config.Collection, joins, joined, page, limit, sort, projection)
+			return
+		}
+		started := time.Now()
+		key, err := listCacheKey(*filter, page, limit, sort, projection, withDistance)
+		if err != nil {
+			// The database is left to reject what can't be encoded
+			cacheConfig = CacheConfig{}
+		}
+		cached, err := cachedRead(ctx, config.Collection, cacheConfig, key, func(ctx context.Context) (interface{}, error) {
+			read := &listPage{}
+			var err error
+			if withDistance {
+				field, point, found := utils.FindNearPoint(*filter)
+				if !found {
+					return nil, errDistanceWithoutNear
+				}
+				read.total, err = db.GetPaginatedNearRecords(ctx, config.Collection, *filter, field, point, distanceField, page, limit, &read.results)
+			} else if joins != nil {
+				read.total, err = db.GetPaginatedJoinedRecords(ctx, config.Collection, joins, joined, page, limit, sort, &read.results)
+			} else {
+				read.total, err = db.GetPaginatedRecords(ctx, config.Collection, *filter, page, limit, sort, projection, &read.results)
+			}
+			return read, err
+		})
+		if err == errDistanceWithoutNear || errors.Is(err, errEncryptedFilter) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
 		if err != nil {
 			c.String(http.StatusInternalServerError, err.Error())
 			return
 		}
+		logSlowQuery(c, db, config.Collection, "list", bson.M{"filter": joined, "sort": sort, "joins": joins, "page": page, "limit": limit}, started)
+		total, results := cached.(*listPage).total, cached.(*listPage).results
 		var resultToReturn []map[string]interface{}
 
 		for _, item := range results {
-			newItem := make(map[string]interface{}) // Initialize the map here
-			for key, value := range item {
-				_, err = utils.Get(utils.ConvertToCamelCase(key), response)
-				if err != nil {
-					continue
+			withComputed, err := withComputedFields(schema, item)
+			if err != nil {
+				c.String(http.StatusInternalServerError, fmt.Sprintf("%s: %s", config.Collection, err.Error()))
+				return
+			}
+			newItem := withoutFields(keepResponseFields(response, withComputed), invisible)
+			for _, key := range []string{searchScoreField, distanceField} {
+				if value, exists := item[key]; exists {
+					newItem[key] = value
 				}
-				newItem[key] = value
 			}
 			resultToReturn = append(resultToReturn, newItem)
 		}
@@ -459,6 +700,26 @@ func GenerateGetAllHandler(db MongoDBconnector, config HandlerConfig) gin.Handle
 	}
 }
 
+// listPage is a page of records read by a list endpoint.
+type listPage struct {
+	total   int64
+	results []map[string]interface{}
+}
+
+var errDistanceWithoutNear = errors.New("Distances require a near() condition in the filter")
+
+// keepResponseFields drops from a record the keys the response struct doesn't declare.
+func keepResponseFields(response interface{}, item map[string]interface{}) map[string]interface{} {
+	newItem := make(map[string]interface{})
+	for key, value := range item {
+		if _, err := utils.Get(utils.ConvertToCamelCase(key), response); err != nil {
+			continue
+		}
+		newItem[key] = value
+	}
+	return newItem
+}
+
 func contains(slice []string, item string) bool {
 	for _, s := range slice {
 		if s == item {
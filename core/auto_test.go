@@ -0,0 +1,13 @@
+package core
+
+import "testing"
+
+func TestSetOwnerUsesTheGoFieldName(t *testing.T) {
+	model := &struct {
+		CreatedBy string `json:"created_by"`
+	}{}
+	setOwner(model, ForeignKeyConfig{Name: "created_by", Model: "user"}, "42")
+	if model.CreatedBy != "42" {
+		t.Errorf("the owner is %q, want 42", model.CreatedBy)
+	}
+}
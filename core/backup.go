@@ -0,0 +1,503 @@
+package core
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const backupManifestName = "manifest.json"
+
+const restoreBatchSize = 1000
+
+// BackupManifest describes a backup archive. Schemas maps every json/ file to the sha256 of
+// its content, which is what restore compares against the running instance.
+type BackupManifest struct {
+	CreatedAt   time.Time         `json:"created_at"`
+	Database    string            `json:"database"`
+	Schemas     map[string]string `json:"schemas"`
+	Collections []string          `json:"collections"`
+}
+
+// schemaVersions hashes every schema of the json/ directory.
+func schemaVersions() (map[string]string, map[string][]byte, error) {
+	entries, err := os.ReadDir("json")
+	if err != nil {
+		return nil, nil, err
+	}
+	versions := make(map[string]string)
+	contents := make(map[string][]byte)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join("json", entry.Name()))
+		if err != nil {
+			return nil, nil, err
+		}
+		sum := sha256.Sum256(content)
+		versions[entry.Name()] = hex.EncodeToString(sum[:])
+		contents[entry.Name()] = content
+	}
+	return versions, contents, nil
+}
+
+func writeTarFile(archive *tar.Writer, name string, content []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := archive.Write(content)
+	return err
+}
+
+// writeCollectionFile writes the documents of a collection into the archive. They are spooled
+// to a temporary file first, since a tar header needs the size of its content, so that large
+// collections aren't held in memory.
+func writeCollectionFile(ctx context.Context, db MongoDBconnector, archive *tar.Writer, collection string) error {
+	spool, err := os.CreateTemp("", "naboobase-backup-*.jsonl")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	// Documents are kept as canonical extended JSON so that every BSON type survives
+	documents := bufio.NewWriter(spool)
+	// Encrypted fields stay sealed in the archive
+	err = db.IterateRawRecords(ctx, collection, bson.M{}, func(record bson.M) error {
+		line, err := bson.MarshalExtJSON(record, true, false)
+		if err != nil {
+			return err
+		}
+		documents.Write(line)
+		return documents.WriteByte('\n')
+	})
+	if err != nil {
+		return err
+	}
+	if err := documents.Flush(); err != nil {
+		return err
+	}
+	size, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:    fmt.Sprintf("collections/%s.jsonl", collection),
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, spool)
+	return err
+}
+
+// WriteBackup writes a gzipped tar archive holding the manifest, the json/ schemas, and the
+// documents and index definitions of every collection of the database, migration state
+// included, to w.
+func WriteBackup(ctx context.Context, db MongoDBconnector, w io.Writer) (*BackupManifest, error) {
+	versions, contents, err := schemaVersions()
+	if err != nil {
+		return nil, err
+	}
+	collections, err := db.ListCollections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(collections)
+	manifest := &BackupManifest{
+		CreatedAt:   time.Now().UTC(),
+		Database:    db.DBName,
+		Schemas:     versions,
+		Collections: collections,
+	}
+
+	compressor := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressor)
+
+	encodedManifest, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(archive, backupManifestName, encodedManifest); err != nil {
+		return nil, err
+	}
+	for name, content := range contents {
+		if err := writeTarFile(archive, "schemas/"+name, content); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, collection := range collections {
+		indexes, err := db.ListIndexes(ctx, collection)
+		if err != nil {
+			return nil, err
+		}
+		encodedIndexes, err := bson.MarshalExtJSON(bson.M{"indexes": indexes}, true, false)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeTarFile(archive, fmt.Sprintf("indexes/%s.json", collection), encodedIndexes); err != nil {
+			return nil, err
+		}
+
+		if err := writeCollectionFile(ctx, db, archive, collection); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, compressor.Close()
+}
+
+// checkSchemaVersions refuses an archive taken with schemas different from the running ones.
+func checkSchemaVersions(manifest *BackupManifest) error {
+	versions, _, err := schemaVersions()
+	if err != nil {
+		return err
+	}
+	var mismatches []string
+	for name, version := range manifest.Schemas {
+		current, ok := versions[name]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("%s is missing", name))
+		} else if current != version {
+			mismatches = append(mismatches, fmt.Sprintf("%s has changed", name))
+		}
+	}
+	for name := range versions {
+		if _, ok := manifest.Schemas[name]; !ok {
+			mismatches = append(mismatches, fmt.Sprintf("%s is not in the backup", name))
+		}
+	}
+	if len(mismatches) != 0 {
+		sort.Strings(mismatches)
+		return fmt.Errorf("the backup schemas don't match the running ones: %s", strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+func restoreCollection(ctx context.Context, db MongoDBconnector, collection string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var batch []interface{}
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var record bson.D
+		if err := bson.UnmarshalExtJSON(line, true, &record); err != nil {
+			return fmt.Errorf("invalid document in %s: %w", collection, err)
+		}
+		batch = append(batch, record)
+		if len(batch) >= restoreBatchSize {
+			if err := db.InsertRecords(ctx, collection, batch); err != nil {
+				return err
+			}
+			batch = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(batch) != 0 {
+		return db.InsertRecords(ctx, collection, batch)
+	}
+	return nil
+}
+
+// indexSpec turns an index definition listed by the database into the spec creating it, ok is
+// false for the _id index. Specs are kept as documents so that the order of compound and text
+// index keys survives.
+func indexSpec(definition bson.D) (bson.D, bool) {
+	spec := bson.D{}
+	for _, element := range definition {
+		switch element.Key {
+		case "name":
+			if element.Value == "_id_" {
+				return nil, false
+			}
+		case "v", "ns":
+			continue
+		}
+		spec = append(spec, element)
+	}
+	return spec, true
+}
+
+func restoreIndexes(ctx context.Context, db MongoDBconnector, collection string, r io.Reader) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var definitions struct {
+		Indexes []bson.D `bson:"indexes"`
+	}
+	if err := bson.UnmarshalExtJSON(content, true, &definitions); err != nil {
+		return fmt.Errorf("invalid index definitions for %s: %w", collection, err)
+	}
+	var specs []bson.D
+	for _, definition := range definitions.Indexes {
+		if spec, ok := indexSpec(definition); ok {
+			specs = append(specs, spec)
+		}
+	}
+	if len(specs) == 0 {
+		return nil
+	}
+	return db.CreateIndexSpecs(ctx, collection, specs)
+}
+
+// dropExtraCollections drops the collections created after a backup was taken, so that the
+// restored database only holds what the archive does.
+func dropExtraCollections(ctx context.Context, db MongoDBconnector, manifest *BackupManifest) error {
+	archived := make(map[string]bool, len(manifest.Collections))
+	for _, collection := range manifest.Collections {
+		archived[collection] = true
+	}
+	collections, err := db.ListCollections(ctx)
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		if archived[collection] || strings.HasPrefix(collection, "system.") {
+			continue
+		}
+		if err := db.DropCollection(ctx, collection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoringCollection names the temporary collection a collection is restored into.
+func restoringCollection(collection string) string {
+	return "_restoring_" + collection
+}
+
+// RestoreBackup replaces the data of the database with the content of an archive written by
+// WriteBackup, after checking that its schemas match the running ones. Collections are
+// restored into temporary ones, which only replace the current collections once the whole
+// archive has loaded, so that an invalid archive leaves the database as it was.
+func RestoreBackup(ctx context.Context, db MongoDBconnector, r io.Reader) (manifest *BackupManifest, err error) {
+	decompressor, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressor.Close()
+	archive := tar.NewReader(decompressor)
+
+	var restored []string
+	created := make(map[string]bool)
+	createOnce := func(collection string) error {
+		if created[collection] {
+			return nil
+		}
+		created[collection] = true
+		restored = append(restored, collection)
+		// Left over by an interrupted restore
+		if err := db.DropCollection(ctx, restoringCollection(collection)); err != nil {
+			return err
+		}
+		// Created even when empty, so that it can be renamed
+		return db.CreateCollection(ctx, restoringCollection(collection))
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, collection := range restored {
+			if dropErr := db.DropCollection(ctx, restoringCollection(collection)); dropErr != nil {
+				fmt.Printf("Error dropping %s: %s\n", restoringCollection(collection), dropErr.Error())
+			}
+		}
+	}()
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == backupManifestName {
+			manifest = &BackupManifest{}
+			if err := json.NewDecoder(archive).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("invalid manifest: %w", err)
+			}
+			if err := checkSchemaVersions(manifest); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// The manifest is always written first, nothing is loaded before it is checked
+		if manifest == nil {
+			return nil, errors.New("the archive doesn't start with a manifest")
+		}
+		switch {
+		case strings.HasPrefix(header.Name, "collections/"):
+			collection := strings.TrimSuffix(strings.TrimPrefix(header.Name, "collections/"), ".jsonl")
+			if err := createOnce(collection); err != nil {
+				return nil, err
+			}
+			if err := restoreCollection(ctx, db, restoringCollection(collection), archive); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(header.Name, "indexes/"):
+			collection := strings.TrimSuffix(strings.TrimPrefix(header.Name, "indexes/"), ".json")
+			// Indexes come before the documents, so unique indexes are enforced while restoring
+			if err := createOnce(collection); err != nil {
+				return nil, err
+			}
+			if err := restoreIndexes(ctx, db, restoringCollection(collection), archive); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if manifest == nil {
+		return nil, errors.New("the archive has no manifest")
+	}
+
+	for i, collection := range restored {
+		if err := db.RenameCollection(ctx, restoringCollection(collection), collection); err != nil {
+			// The collections renamed so far are already replaced
+			restored = restored[i:]
+			return nil, err
+		}
+	}
+	restored = nil
+	if err := dropExtraCollections(ctx, db, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// WriteBackupFile writes a timestamped backup into dir and returns its path.
+func WriteBackupFile(ctx context.Context, db MongoDBconnector, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("naboobase-%s.tar.gz", time.Now().UTC().Format("20060102-150405")))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := WriteBackup(ctx, db, file); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// pruneBackups keeps the most recent keep backups of dir.
+func pruneBackups(dir string, keep int) error {
+	matches, err := filepath.Glob(filepath.Join(dir, "naboobase-*.tar.gz"))
+	if err != nil {
+		return err
+	}
+	// Names embed the creation time, so the lexical order is the chronological one
+	sort.Strings(matches)
+	for len(matches) > keep {
+		if err := os.Remove(matches[0]); err != nil {
+			return err
+		}
+		matches = matches[1:]
+	}
+	return nil
+}
+
+// ScheduleBackups writes a backup into dir every interval, keeping the last keep ones,
+// until ctx is cancelled.
+func ScheduleBackups(ctx context.Context, db MongoDBconnector, dir string, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			backupCtx, cancel := context.WithTimeout(ctx, interval)
+			path, err := WriteBackupFile(backupCtx, db, dir)
+			cancel()
+			if err != nil {
+				fmt.Printf("Scheduled backup failed: %s\n", err.Error())
+				continue
+			}
+			fmt.Printf("Scheduled backup written to %s\n", path)
+			if err := pruneBackups(dir, keep); err != nil {
+				fmt.Printf("Error removing old backups: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+type BackupManagement struct {
+}
+
+func (backupManagement *BackupManagement) DownloadBackup(db MongoDBconnector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := authorizeRequest(c, AuthRules{ShouldBeAuthenticated: true, OnlyForAdmin: true}); !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Minute)
+		defer cancel()
+		filename := fmt.Sprintf("naboobase-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		c.Header("Content-Type", "application/gzip")
+		// The archive is streamed as it is written, so a failure can only be reported before
+		// its first bytes; afterwards the response is cut short, leaving an invalid gzip stream
+		if _, err := WriteBackup(ctx, db, c.Writer); err != nil {
+			if !c.Writer.Written() {
+				c.Writer.Header().Del("Content-Disposition")
+				c.Writer.Header().Del("Content-Type")
+				c.String(http.StatusInternalServerError, "Failed to write the backup: "+err.Error())
+				return
+			}
+			fmt.Printf("Error streaming the backup: %s\n", err.Error())
+		}
+	}
+}
+
+func (backupManagement *BackupManagement) Init(db MongoDBconnector) []Endpoint {
+	var endpoints []Endpoint = []Endpoint{{
+		Method:  "GET",
+		Path:    "/admin/backup",
+		Handler: backupManagement.DownloadBackup(db),
+	},
+	}
+	return endpoints
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestIndexSpecKeepsKeyOrder(t *testing.T) {
+	listed := bson.M{"indexes": []bson.D{
+		{{Key: "v", Value: 2}, {Key: "key", Value: bson.D{{Key: "_id", Value: 1}}}, {Key: "name", Value: "_id_"}},
+		{
+			{Key: "v", Value: 2},
+			{Key: "key", Value: bson.D{{Key: "record_id", Value: 1}, {Key: "version", Value: 1}}},
+			{Key: "name", Value: "record_id_1_version_1"},
+			{Key: "unique", Value: true},
+		},
+		{
+			{Key: "v", Value: 2},
+			{Key: "key", Value: bson.D{{Key: "_fts", Value: "text"}, {Key: "_ftsx", Value: 1}}},
+			{Key: "name", Value: "search"},
+		},
+	}}
+	encoded, err := bson.MarshalExtJSON(listed, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var definitions struct {
+		Indexes []bson.D `bson:"indexes"`
+	}
+	if err := bson.UnmarshalExtJSON(encoded, true, &definitions); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := indexSpec(definitions.Indexes[0]); ok {
+		t.Error("the _id index should be skipped")
+	}
+	for i, keys := range [][]string{{"record_id", "version"}, {"_fts", "_ftsx"}} {
+		spec, ok := indexSpec(definitions.Indexes[i+1])
+		if !ok {
+			t.Fatalf("index %d was skipped", i+1)
+		}
+		for _, element := range spec {
+			if element.Key == "v" {
+				t.Errorf("index %d keeps its version", i+1)
+			}
+			if element.Key != "key" {
+				continue
+			}
+			key, ok := element.Value.(bson.D)
+			if !ok || len(key) != len(keys) {
+				t.Fatalf("index %d has the keys %v", i+1, element.Value)
+			}
+			for j, name := range keys {
+				if key[j].Key != name {
+					t.Errorf("index %d has the keys %v, want %v", i+1, key, keys)
+				}
+			}
+		}
+	}
+}
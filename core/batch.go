@@ -0,0 +1,235 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/copier"
+	"github.com/lodjim/naboobase/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const maxBatchOperations = 100
+
+type BatchOperation struct {
+	Operation  string          `json:"operation" validate:"required,oneof=create update delete"`
+	Collection string          `json:"collection" validate:"required"`
+	Id         string          `json:"_id"`
+	Data       json.RawMessage `json:"data"`
+}
+
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations" validate:"required,min=1,dive"`
+}
+
+type BatchOperationResult struct {
+	Index      int         `json:"index"`
+	Operation  string      `json:"operation"`
+	Collection string      `json:"collection"`
+	Id         string      `json:"_id,omitempty"`
+	Status     int         `json:"status"`
+	Data       interface{} `json:"data,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	RolledBack bool        `json:"rolled_back,omitempty"`
+}
+
+type preparedOperation struct {
+	operation BatchOperation
+	config    HandlerConfig
+	id        primitive.ObjectID
+	model     interface{}
+	data      map[string]interface{}
+}
+
+type BatchProcessor struct {
+}
+
+func (batchProcessor *BatchProcessor) Init(db MongoDBconnector) []Endpoint {
+	var endpoints []Endpoint = []Endpoint{{
+		Method:  "POST",
+		Path:    "/batch",
+		Handler: batchProcessor.RunBatch(db),
+	},
+	}
+	return endpoints
+}
+
+// prepareBatchOperation applies the auth rules and the validation of the single-record
+// handlers to an operation, without touching the database.
+func prepareBatchOperation(operation BatchOperation, claims *utils.Claims) (*preparedOperation, int, error) {
+	config, ok := HandlerConfigRegistry[operation.Collection]
+	if !ok {
+		return nil, http.StatusNotFound, fmt.Errorf("collection %s is not served", operation.Collection)
+	}
+	var modelConfig ModelConfig
+	if err := loadConfig(config.Collection, &modelConfig); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	prepared := &preparedOperation{operation: operation, config: config}
+
+	if operation.Operation == "create" {
+		if status, err := checkAuthRules(modelConfig.ContentConfigs.Create.AuthRules, claims); err != nil {
+			return nil, status, err
+		}
+		model, status, err := prepareCreate(config, modelConfig, claims, operation.Data)
+		if err != nil {
+			return nil, status, err
+		}
+		prepared.model = model
+		return prepared, http.StatusOK, nil
+	}
+
+	rules := modelConfig.ContentConfigs.Delete.AuthRules
+	if operation.Operation == "update" {
+		rules = modelConfig.ContentConfigs.Update.AuthRules
+	}
+	if status, err := checkAuthRules(rules, claims); err != nil {
+		return nil, status, err
+	}
+	id, err := primitive.ObjectIDFromHex(operation.Id)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	prepared.id = id
+	prepared.model = config.NewModel()
+	if operation.Operation == "update" {
+		data, status, err := prepareUpdate(config, operation.Data)
+		if err != nil {
+			return nil, status, err
+		}
+		prepared.data = data
+	}
+	if config.Preprocess != nil {
+		if err := config.Preprocess(prepared.model, id, nil); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+	return prepared, http.StatusOK, nil
+}
+
+// apply runs a prepared operation against the database and returns the data to report.
+func (prepared *preparedOperation) apply(ctx context.Context, db MongoDBconnector, actor Actor) (string, interface{}, error) {
+	collection := prepared.config.Collection
+	switch prepared.operation.Operation {
+	case "create":
+		if err := createRecord(ctx, db, collection, actor, prepared.model); err != nil {
+			return "", nil, fmt.Errorf("Failed to create record: %w", err)
+		}
+		res := prepared.config.NewResponse()
+		if err := copier.Copy(res, prepared.model); err != nil {
+			return "", nil, err
+		}
+		rendered, err := renderVisible(collection, actor.IsSuperUser, res)
+		return recordId(prepared.model), rendered, err
+	case "update":
+		if err := updateRecord(ctx, db, collection, actor, prepared.id, prepared.data, prepared.model); err != nil {
+			return "", nil, fmt.Errorf("Failed to update the record: %w", err)
+		}
+		res := prepared.config.NewResponse()
+		if err := copier.Copy(res, prepared.model); err != nil {
+			return "", nil, err
+		}
+		rendered, err := renderVisible(collection, actor.IsSuperUser, res)
+		return prepared.id.Hex(), rendered, err
+	case "delete":
+		if err := deleteRecord(ctx, db, collection, actor, prepared.id, prepared.model); err != nil {
+			return "", nil, fmt.Errorf("Failed to delete the record: %w", err)
+		}
+		return prepared.id.Hex(), nil, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported operation: %s", prepared.operation.Operation)
+	}
+}
+
+func (batchProcessor *BatchProcessor) RunBatch(db MongoDBconnector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var payload BatchRequest
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := validate.Struct(&payload); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(payload.Operations) > maxBatchOperations {
+			c.String(http.StatusBadRequest, fmt.Sprintf("A batch can't contain more than %d operations", maxBatchOperations))
+			return
+		}
+
+		claims, ok := authorizeRequest(c, AuthRules{})
+		if !ok {
+			return
+		}
+
+		results := make([]BatchOperationResult, len(payload.Operations))
+		prepared := make([]*preparedOperation, len(payload.Operations))
+		for i, operation := range payload.Operations {
+			results[i] = BatchOperationResult{
+				Index:      i,
+				Operation:  operation.Operation,
+				Collection: operation.Collection,
+				Id:         operation.Id,
+			}
+			operationToApply, status, err := prepareBatchOperation(operation, claims)
+			if err != nil {
+				results[i].Status = status
+				results[i].Error = err.Error()
+				c.JSON(status, gin.H{
+					"error":   fmt.Sprintf("operation %d is invalid, nothing was applied", i),
+					"results": results[:i+1],
+				})
+				return
+			}
+			prepared[i] = operationToApply
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+		defer cancel()
+		actor := actorFromRequest(c)
+		failed := -1
+		err := db.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+			// The driver may retry the whole callback, so every attempt starts from scratch
+			failed = -1
+			for i, operation := range prepared {
+				id, data, err := operation.apply(sessCtx, db, actor)
+				if err != nil {
+					failed = i
+					results[i].Status = http.StatusBadRequest
+					results[i].Error = err.Error()
+					return nil, err
+				}
+				results[i].Id = id
+				results[i].Status = http.StatusOK
+				results[i].Data = data
+				results[i].Error = ""
+			}
+			return nil, nil
+		})
+		if err != nil {
+			if failed < 0 {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to commit the batch: %s", err.Error())})
+				return
+			}
+			for i := 0; i < failed; i++ {
+				results[i].Data = nil
+				results[i].RolledBack = true
+			}
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   fmt.Sprintf("operation %d failed, the whole batch was rolled back", failed),
+				"results": results[:failed+1],
+			})
+			return
+		}
+		// Reads made while the transaction was running may have cached the previous versions
+		for _, result := range results {
+			invalidateCache(result.Collection, result.Id)
+		}
+		c.JSON(http.StatusOK, gin.H{"results": results})
+	}
+}
@@ -0,0 +1,322 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/copier"
+	"github.com/lodjim/naboobase/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const defaultBulkMaxRecords = 1000
+
+type BulkRecordError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+func bulkMaxRecords(modelConfig ModelConfig) int64 {
+	if modelConfig.ContentConfigs.Bulk.MaxRecords > 0 {
+		return modelConfig.ContentConfigs.Bulk.MaxRecords
+	}
+	return defaultBulkMaxRecords
+}
+
+// bulkFilter compiles the mandatory filter of the bulk update and delete endpoints.
+func bulkFilter(c *gin.Context, collection string) (bson.M, bool) {
+	filterSearch := c.Query("filter")
+	if filterSearch == "" {
+		c.String(http.StatusBadRequest, "A filter is required for bulk operations")
+		return nil, false
+	}
+	query, err := compileRequestFilter(c, collection, filterSearch)
+	if err != nil {
+		c.String(http.StatusBadRequest, "The filter used is not appropriate: "+err.Error())
+		return nil, false
+	}
+	if err := rejectRelations(collection, query); err != nil {
+		c.String(http.StatusBadRequest, "The filter used is not appropriate: "+err.Error())
+		return nil, false
+	}
+	return query, true
+}
+
+func GenerateBulkCreateHandler(db MongoDBconnector, config HandlerConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var modelConfig ModelConfig
+		if err := loadConfig(config.Collection, &modelConfig); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		claims, ok := authorizeRequest(c, modelConfig.ContentConfigs.Create.AuthRules)
+		if !ok {
+			return
+		}
+
+		var payload []json.RawMessage
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(payload) == 0 {
+			c.String(http.StatusBadRequest, "The payload should be a non empty array")
+			return
+		}
+		if maxRecords := bulkMaxRecords(modelConfig); int64(len(payload)) > maxRecords {
+			c.String(http.StatusBadRequest, fmt.Sprintf("At most %d records can be created at once", maxRecords))
+			return
+		}
+
+		records := make([]interface{}, 0, len(payload))
+		var recordErrors []BulkRecordError
+		for i, element := range payload {
+			model, _, err := prepareCreate(config, modelConfig, claims, element)
+			if err != nil {
+				recordErrors = append(recordErrors, BulkRecordError{Index: i, Error: err.Error()})
+				continue
+			}
+			records = append(records, model)
+		}
+		if len(recordErrors) != 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Some records are invalid, nothing was created", "errors": recordErrors})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+		defer cancel()
+		actor := actorFromRequest(c)
+		// The records are created along with the records of their creation, or not at all
+		err := db.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+			if err := db.BulkCreateRecords(sessCtx, config.Collection, records); err != nil {
+				return nil, err
+			}
+			for _, model := range records {
+				after, err := toDocument(model)
+				if err != nil {
+					return nil, err
+				}
+				err = recordChange(sessCtx, db, RecordChange{Collection: config.Collection, RecordId: recordId(model), Operation: "create", After: after, Actor: actor})
+				if err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		})
+		if err != nil {
+			c.String(http.StatusBadRequest, "Failed to create records: "+err.Error())
+			return
+		}
+		// Reads made while the transaction was running may have cached the previous lists
+		for _, model := range records {
+			invalidateCache(config.Collection, recordId(model))
+		}
+
+		superuser := requestIsSuperUser(c)
+		responses := make([]interface{}, 0, len(records))
+		for _, model := range records {
+			res := config.NewResponse()
+			if err := copier.Copy(res, model); err != nil {
+				c.String(http.StatusInternalServerError, err.Error())
+				return
+			}
+			rendered, err := renderVisible(config.Collection, superuser, res)
+			if err != nil {
+				c.String(http.StatusInternalServerError, err.Error())
+				return
+			}
+			responses = append(responses, rendered)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"total": len(responses),
+			"data":  responses,
+		})
+	}
+}
+
+func GenerateBulkUpdateHandler(db MongoDBconnector, config HandlerConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var modelConfig ModelConfig
+		if err := loadConfig(config.Collection, &modelConfig); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		if _, ok := authorizeRequest(c, modelConfig.ContentConfigs.Update.AuthRules); !ok {
+			return
+		}
+		filter, ok := bulkFilter(c, config.Collection)
+		if !ok {
+			return
+		}
+		rawData, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to read request body"})
+			return
+		}
+		data, status, err := prepareUpdate(config, rawData)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		for _, field := range utils.GetTaggedFields(config.NewModel(), "unique") {
+			if _, exists := data[utils.ConvertToSnakeCase(field)]; exists {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("The unique field %s can't be updated in bulk", field)})
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+		defer cancel()
+		maxRecords := bulkMaxRecords(modelConfig)
+		actor := actorFromRequest(c)
+		var ids []primitive.ObjectID
+		var modified int64
+		errorStatus := http.StatusInternalServerError
+		// The records are updated along with the records of their changes, or not at all
+		err = db.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+			errorStatus = http.StatusInternalServerError
+			before, found, err := matchingRecords(sessCtx, db, config.Collection, filter, maxRecords+1)
+			if err != nil {
+				return nil, err
+			}
+			ids, modified = found, 0
+			if int64(len(ids)) > maxRecords {
+				errorStatus = http.StatusBadRequest
+				return nil, fmt.Errorf("The filter matches more than %d records, at most %d can be updated at once", maxRecords, maxRecords)
+			}
+			if len(ids) == 0 {
+				return nil, nil
+			}
+			// Only touch the records read above, so that every change can be recorded
+			matched := idFilter(ids)
+			modified, err = db.UpdateManyRecords(sessCtx, config.Collection, matched, data)
+			if err != nil {
+				errorStatus = http.StatusBadRequest
+				return nil, fmt.Errorf("Failed to update the records: %w", err)
+			}
+			after, _, err := matchingRecords(sessCtx, db, config.Collection, matched, 0)
+			if err != nil {
+				return nil, err
+			}
+			if err := recomputeStoredFields(sessCtx, db, config.Collection, after); err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				if after[id] == nil {
+					continue
+				}
+				err := recordChange(sessCtx, db, RecordChange{Collection: config.Collection, RecordId: id.Hex(), Operation: "update", Before: before[id], After: after[id], Actor: actor})
+				if err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		})
+		if err != nil {
+			c.String(errorStatus, err.Error())
+			return
+		}
+		// Reads made while the transaction was running may have cached the previous versions
+		for _, id := range ids {
+			invalidateCache(config.Collection, id.Hex())
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"matched":  len(ids),
+			"modified": modified,
+		})
+	}
+}
+
+func GenerateBulkDeleteHandler(db MongoDBconnector, config HandlerConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var modelConfig ModelConfig
+		if err := loadConfig(config.Collection, &modelConfig); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		if _, ok := authorizeRequest(c, modelConfig.ContentConfigs.Delete.AuthRules); !ok {
+			return
+		}
+		filter, ok := bulkFilter(c, config.Collection)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+		defer cancel()
+		maxRecords := bulkMaxRecords(modelConfig)
+		actor := actorFromRequest(c)
+		var ids []primitive.ObjectID
+		var deleted int64
+		errorStatus := http.StatusInternalServerError
+		// The records are deleted along with the records of their deletion, or not at all
+		err := db.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+			errorStatus = http.StatusInternalServerError
+			before, found, err := matchingRecords(sessCtx, db, config.Collection, filter, maxRecords+1)
+			if err != nil {
+				return nil, err
+			}
+			ids, deleted = found, 0
+			if int64(len(ids)) > maxRecords {
+				errorStatus = http.StatusBadRequest
+				return nil, fmt.Errorf("The filter matches more than %d records, at most %d can be deleted at once", maxRecords, maxRecords)
+			}
+			if len(ids) == 0 {
+				return nil, nil
+			}
+			deleted, err = db.DeleteManyRecords(sessCtx, config.Collection, idFilter(ids))
+			if err != nil {
+				errorStatus = http.StatusBadRequest
+				return nil, fmt.Errorf("Failed to delete the records: %w", err)
+			}
+			for _, id := range ids {
+				err := recordChange(sessCtx, db, RecordChange{Collection: config.Collection, RecordId: id.Hex(), Operation: "delete", Before: before[id], Actor: actor})
+				if err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		})
+		if err != nil {
+			c.String(errorStatus, err.Error())
+			return
+		}
+		// Reads made while the transaction was running may have cached the deleted records
+		for _, id := range ids {
+			invalidateCache(config.Collection, id.Hex())
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"deleted": deleted,
+		})
+	}
+}
+
+// recomputeStoredFields updates the stored computed fields of records changed by a bulk
+// update, which can't be computed beforehand since they differ from a record to another.
+func recomputeStoredFields(ctx context.Context, db MongoDBconnector, collection string, records map[primitive.ObjectID]bson.M) error {
+	schema, err := loadSchema(collection)
+	if err != nil {
+		return err
+	}
+	if len(computedFields(schema, true)) == 0 {
+		return nil
+	}
+	for id, record := range records {
+		values, err := storedComputedValues(schema, record)
+		if err != nil {
+			return err
+		}
+		var updated bson.M
+		if err := db.UpdateRecord(ctx, collection, id, values, &updated); err != nil {
+			return err
+		}
+		records[id] = updated
+	}
+	return nil
+}
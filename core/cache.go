@@ -0,0 +1,234 @@
+package core
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/sync/singleflight"
+)
+
+const defaultCacheTTL = time.Minute
+
+const defaultCacheMaxEntries = 1000
+
+const cacheLoadTimeout = 10 * time.Second
+
+type CacheConfig struct {
+	Enabled    bool   `json:"enabled"`
+	TTL        string `json:"ttl"` // A Go duration such as "30s", one minute when empty
+	MaxEntries int    `json:"max_entries"`
+}
+
+func (cacheConfig CacheConfig) ttl() time.Duration {
+	ttl, err := time.ParseDuration(cacheConfig.TTL)
+	if err != nil || ttl <= 0 {
+		return defaultCacheTTL
+	}
+	return ttl
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// readCache is the LRU cache of the reads of one collection. Every invalidation bumps the
+// generation, so that reads started before a write don't store what they got once it's done.
+type readCache struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	order      *list.List
+	generation uint64
+	group      singleflight.Group
+}
+
+var readCaches = make(map[string]*readCache)
+
+var readCachesMu sync.Mutex
+
+func collectionCache(collection string) *readCache {
+	readCachesMu.Lock()
+	defer readCachesMu.Unlock()
+	cache, ok := readCaches[collection]
+	if !ok {
+		cache = &readCache{entries: make(map[string]*list.Element), order: list.New()}
+		readCaches[collection] = cache
+	}
+	return cache
+}
+
+func (cache *readCache) get(key string) (interface{}, uint64, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, cache.generation, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return nil, cache.generation, false
+	}
+	cache.order.MoveToFront(element)
+	return entry.value, cache.generation, true
+}
+
+func (cache *readCache) set(key string, value interface{}, generation uint64, cacheConfig CacheConfig) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if generation != cache.generation {
+		return
+	}
+	entry := &cacheEntry{key: key, value: value, expires: time.Now().Add(cacheConfig.ttl())}
+	if element, ok := cache.entries[key]; ok {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+	} else {
+		cache.entries[key] = cache.order.PushFront(entry)
+	}
+	maxEntries := cacheConfig.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+	for cache.order.Len() > maxEntries {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate drops the cached record of an ID, along with every cached list since any of
+// them may contain it.
+func (cache *readCache) invalidate(recordId string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.generation++
+	for key, element := range cache.entries {
+		if key == recordCacheKey(recordId) || strings.HasPrefix(key, listCacheKeyPrefix) {
+			cache.order.Remove(element)
+			delete(cache.entries, key)
+		}
+	}
+}
+
+const listCacheKeyPrefix = "list:"
+
+func recordCacheKey(recordId string) string {
+	return "record:" + recordId
+}
+
+// listCacheKey identifies a list read by everything sent to the database. The parts are hashed
+// as canonical extended JSON, which keeps their BSON types apart, with the keys of their maps
+// sorted so that equal queries get equal keys.
+func listCacheKey(parts ...interface{}) (string, error) {
+	canonical := make(bson.A, len(parts))
+	for i, part := range parts {
+		canonical[i] = sortedKeys(part)
+	}
+	encoded, err := bson.MarshalExtJSON(bson.D{{Key: "parts", Value: canonical}}, true, false)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(encoded)
+	return listCacheKeyPrefix + hex.EncodeToString(hash[:]), nil
+}
+
+// sortedKeys turns the maps of a query into documents with sorted keys, maps being encoded
+// in random order.
+func sortedKeys(value interface{}) interface{} {
+	switch value := value.(type) {
+	case bson.M:
+		return sortedDocument(value)
+	case map[string]interface{}:
+		return sortedDocument(value)
+	case bson.D:
+		document := make(bson.D, len(value))
+		for i, element := range value {
+			document[i] = bson.E{Key: element.Key, Value: sortedKeys(element.Value)}
+		}
+		return document
+	case bson.A:
+		return sortedArray(value)
+	case []interface{}:
+		return sortedArray(value)
+	case []bson.M:
+		array := make(bson.A, len(value))
+		for i, element := range value {
+			array[i] = sortedDocument(element)
+		}
+		return array
+	}
+	return value
+}
+
+func sortedDocument(value map[string]interface{}) bson.D {
+	keys := make([]string, 0, len(value))
+	for key := range value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	document := make(bson.D, len(keys))
+	for i, key := range keys {
+		document[i] = bson.E{Key: key, Value: sortedKeys(value[key])}
+	}
+	return document
+}
+
+func sortedArray(value []interface{}) bson.A {
+	array := make(bson.A, len(value))
+	for i, element := range value {
+		array[i] = sortedKeys(element)
+	}
+	return array
+}
+
+// cachedRead returns the cached result of a read, or runs it once for all the concurrent
+// callers asking for the same key. The shared read runs under its own timeout rather than the
+// context of whichever caller started it, so that one cancelled request doesn't fail the
+// others; each caller still stops waiting when its own ctx is done. Errors aren't cached. The
+// returned value is shared and must not be modified.
+func cachedRead(ctx context.Context, collection string, cacheConfig CacheConfig, key string, read func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if !cacheConfig.Enabled {
+		return read(ctx)
+	}
+	cache := collectionCache(collection)
+	value, generation, ok := cache.get(key)
+	if ok {
+		return value, nil
+	}
+	loaded := cache.group.DoChan(fmt.Sprintf("%d:%s", generation, key), func() (interface{}, error) {
+		loadCtx, cancel := context.WithTimeout(context.Background(), cacheLoadTimeout)
+		defer cancel()
+		value, err := read(loadCtx)
+		if err == nil {
+			cache.set(key, value, generation, cacheConfig)
+		}
+		return value, err
+	})
+	select {
+	case result := <-loaded:
+		return result.Val, result.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// invalidateCache drops the cached reads a write on a record may have changed.
+func invalidateCache(collection string, recordId string) {
+	readCachesMu.Lock()
+	cache, ok := readCaches[collection]
+	readCachesMu.Unlock()
+	if ok {
+		cache.invalidate(recordId)
+	}
+}
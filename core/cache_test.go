@@ -0,0 +1,206 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestListCacheKeyKeepsTypesApart(t *testing.T) {
+	id := primitive.NewObjectID()
+	pairs := [][2]interface{}{
+		{bson.M{"age": 1}, bson.M{"age": "1"}},
+		{bson.M{"age": int32(1)}, bson.M{"age": int64(1)}},
+		{bson.M{"_id": id}, bson.M{"_id": id.Hex()}},
+		{bson.M{"tags": bson.A{"a b"}}, bson.M{"tags": bson.A{"a", "b"}}},
+		{bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 1}}, bson.D{{Key: "b", Value: 1}, {Key: "a", Value: 1}}},
+	}
+	for _, pair := range pairs {
+		first, err := listCacheKey(pair[0], int64(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := listCacheKey(pair[1], int64(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == second {
+			t.Errorf("%v and %v share the key %s", pair[0], pair[1], first)
+		}
+	}
+}
+
+func TestListCacheKeySortsMaps(t *testing.T) {
+	filter := bson.M{
+		"$or": []bson.M{{"a": 1, "b": 2, "c": 3}, {"d": bson.M{"$in": bson.A{1, 2}}, "e": 5}},
+		"f":   map[string]interface{}{"g": 1, "h": 2, "i": 3},
+	}
+	want, err := listCacheKey(filter, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if got, _ := listCacheKey(filter, nil); got != want {
+			t.Fatalf("the key of the same filter changed from %s to %s", want, got)
+		}
+	}
+}
+
+// freshCache drops the cache of a collection, left over by a previous run of a test.
+func freshCache(collection string) {
+	readCachesMu.Lock()
+	delete(readCaches, collection)
+	readCachesMu.Unlock()
+}
+
+// countedRead returns a read of value counting its calls.
+func countedRead(value interface{}, calls *int32) func(context.Context) (interface{}, error) {
+	return func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(calls, 1)
+		return value, nil
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	freshCache("cache_lru")
+	config := CacheConfig{Enabled: true, MaxEntries: 2}
+	ctx := context.Background()
+	var calls int32
+	for _, key := range []string{"a", "b", "a", "c"} {
+		if _, err := cachedRead(ctx, "cache_lru", config, key, countedRead(key, &calls)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a was used after b, so c evicted b
+	for key, cached := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, _, ok := collectionCache("cache_lru").get(key); ok != cached {
+			t.Errorf("%s is cached: %t, want %t", key, ok, cached)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("the reads ran %d times, want 3", calls)
+	}
+}
+
+func TestCacheExpiresEntries(t *testing.T) {
+	freshCache("cache_ttl")
+	config := CacheConfig{Enabled: true, TTL: "1h"}
+	ctx := context.Background()
+	var calls int32
+	for i := 0; i < 2; i++ {
+		if _, err := cachedRead(ctx, "cache_ttl", config, "a", countedRead("a", &calls)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("the read ran %d times before expiring, want 1", calls)
+	}
+	cache := collectionCache("cache_ttl")
+	cache.mu.Lock()
+	cache.entries["a"].Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+	cache.mu.Unlock()
+	if _, err := cachedRead(ctx, "cache_ttl", config, "a", countedRead("a", &calls)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("the read ran %d times after expiring, want 2", calls)
+	}
+}
+
+func TestCacheInvalidatesOnWrite(t *testing.T) {
+	freshCache("cache_write")
+	config := CacheConfig{Enabled: true}
+	ctx := context.Background()
+	var calls int32
+	keys := []string{recordCacheKey("1"), recordCacheKey("2"), listCacheKeyPrefix + "page"}
+	for _, key := range keys {
+		if _, err := cachedRead(ctx, "cache_write", config, key, countedRead(key, &calls)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	invalidateCache("cache_write", "1")
+	for key, cached := range map[string]bool{keys[0]: false, keys[1]: true, keys[2]: false} {
+		if _, _, ok := collectionCache("cache_write").get(key); ok != cached {
+			t.Errorf("%s is cached: %t, want %t", key, ok, cached)
+		}
+	}
+
+	// A read started before a write doesn't store what it got
+	started, release := make(chan bool), make(chan bool)
+	done := make(chan error)
+	go func() {
+		_, err := cachedRead(ctx, "cache_write", config, keys[1]+"stale", func(ctx context.Context) (interface{}, error) {
+			started <- true
+			<-release
+			return "stale", nil
+		})
+		done <- err
+	}()
+	<-started
+	invalidateCache("cache_write", "2")
+	release <- true
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := collectionCache("cache_write").get(keys[1] + "stale"); ok {
+		t.Error("a read started before a write was cached")
+	}
+}
+
+func TestCacheCoalescesReads(t *testing.T) {
+	freshCache("cache_coalesce")
+	config := CacheConfig{Enabled: true}
+	var calls int32
+	started, release := make(chan bool), make(chan bool)
+	read := func(ctx context.Context) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			started <- true
+			<-release
+		}
+		return "value", ctx.Err()
+	}
+
+	// The first caller gives up while the read runs, the others still get its result
+	firstCtx, cancel := context.WithCancel(context.Background())
+	firstDone := make(chan error)
+	go func() {
+		_, err := cachedRead(firstCtx, "cache_coalesce", config, "a", read)
+		firstDone <- err
+	}()
+	<-started
+	cancel()
+	if err := <-firstDone; err != context.Canceled {
+		t.Fatalf("the cancelled caller got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := cachedRead(context.Background(), "cache_coalesce", config, "a", read)
+			if err == nil && value != "value" {
+				t.Errorf("got %v", value)
+			}
+			errs <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	release <- true
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("the read ran %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,275 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/lodjim/naboobase/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// computedPrograms caches the compiled expressions of computed fields.
+var computedPrograms sync.Map
+
+func computedFields(schema *CollectionSchema, stored bool) []utils.FieldDefinition {
+	var fields []utils.FieldDefinition
+	for _, field := range schema.Root.Fields {
+		if field.SchemaType == "computed" && field.Stored == stored {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// exprValue converts what the driver decodes into values expressions can work with.
+func exprValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case primitive.ObjectID:
+		return v.Hex()
+	case primitive.DateTime:
+		return v.Time()
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case primitive.A:
+		values := make([]interface{}, len(v))
+		for i, element := range v {
+			values[i] = exprValue(element)
+		}
+		return values
+	case bson.M:
+		return exprEnv(v)
+	case map[string]interface{}:
+		return exprEnv(v)
+	case bson.D:
+		return exprEnv(v.Map())
+	}
+	return value
+}
+
+func exprEnv(record map[string]interface{}) map[string]interface{} {
+	env := make(map[string]interface{}, len(record))
+	for key, value := range record {
+		env[key] = exprValue(value)
+	}
+	return env
+}
+
+// evaluateComputed evaluates the expression of a computed field against a record. Fields
+// missing from the record are nil.
+func evaluateComputed(field utils.FieldDefinition, env map[string]interface{}) (interface{}, error) {
+	program, ok := computedPrograms.Load(field.Expr)
+	if !ok {
+		compiled, err := expr.Compile(field.Expr, expr.AllowUndefinedVariables())
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile the expression of %s: %w", field.JSONTag, err)
+		}
+		program, _ = computedPrograms.LoadOrStore(field.Expr, compiled)
+	}
+	value, err := expr.Run(program.(*vm.Program), env)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate the expression of %s: %w", field.JSONTag, err)
+	}
+	return value, nil
+}
+
+// withComputedFields returns a copy of a record read from the database with the values of
+// its computed fields that aren't stored.
+func withComputedFields(schema *CollectionSchema, record map[string]interface{}) (map[string]interface{}, error) {
+	fields := computedFields(schema, false)
+	if len(fields) == 0 {
+		return record, nil
+	}
+	withComputed := make(map[string]interface{}, len(record)+len(fields))
+	for key, value := range record {
+		withComputed[key] = value
+	}
+	env := exprEnv(record)
+	for _, field := range fields {
+		value, err := evaluateComputed(field, env)
+		if err != nil {
+			return nil, err
+		}
+		withComputed[field.JSONTag] = value
+	}
+	return withComputed, nil
+}
+
+// modelWithComputedFields renders a model read from the database as json, along with the
+// values of its computed fields.
+func modelWithComputedFields(collection string, model interface{}) (interface{}, error) {
+	schema, err := loadSchema(collection)
+	if err != nil {
+		return nil, err
+	}
+	fields := computedFields(schema, false)
+	if len(fields) == 0 {
+		return model, nil
+	}
+	document, err := toDocument(model)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	var rendered map[string]interface{}
+	if err := json.Unmarshal(encoded, &rendered); err != nil {
+		return nil, err
+	}
+	computed, err := withComputedFields(schema, document)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", collection, err)
+	}
+	for _, field := range fields {
+		rendered[field.JSONTag] = computed[field.JSONTag]
+	}
+	return rendered, nil
+}
+
+// storedComputedValues evaluates the stored computed fields of a record about to be written.
+func storedComputedValues(schema *CollectionSchema, record map[string]interface{}) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	env := exprEnv(record)
+	for _, field := range computedFields(schema, true) {
+		value, err := evaluateComputed(field, env)
+		if err != nil {
+			return nil, err
+		}
+		values[field.JSONTag] = value
+	}
+	return values, nil
+}
+
+// setModelField sets a field of a model from a value of a compatible type.
+func setModelField(model interface{}, name string, value interface{}) error {
+	field := reflect.ValueOf(model).Elem().FieldByName(name)
+	if !field.IsValid() {
+		return fmt.Errorf("no such field: %s", name)
+	}
+	if value == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	converted := reflect.ValueOf(value)
+	if converted.Type().AssignableTo(field.Type()) {
+		field.Set(converted)
+		return nil
+	}
+	if converted.Type().ConvertibleTo(field.Type()) && converted.Kind() != reflect.String && field.Kind() != reflect.String {
+		field.Set(converted.Convert(field.Type()))
+		return nil
+	}
+	// Fall back on json, e.g. for a time stored as a string
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, field.Addr().Interface())
+}
+
+// computeStoredFields sets the stored computed fields of a model about to be inserted.
+func computeStoredFields(collection string, model interface{}) error {
+	schema, err := loadSchema(collection)
+	if err != nil {
+		return err
+	}
+	if len(computedFields(schema, true)) == 0 {
+		return nil
+	}
+	document, err := toDocument(model)
+	if err != nil {
+		return err
+	}
+	values, err := storedComputedValues(schema, document)
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		if err := setModelField(model, utils.ToGoFieldName(name), value); err != nil {
+			return fmt.Errorf("the value of %s doesn't fit the field: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// computeStoredUpdate adds to update data the stored computed fields of the updated record.
+func computeStoredUpdate(collection string, before bson.M, data map[string]interface{}) error {
+	schema, err := loadSchema(collection)
+	if err != nil {
+		return err
+	}
+	if len(computedFields(schema, true)) == 0 {
+		return nil
+	}
+	merged := make(map[string]interface{}, len(before)+len(data))
+	for key, value := range before {
+		merged[key] = value
+	}
+	for key, value := range data {
+		merged[key] = value
+	}
+	values, err := storedComputedValues(schema, merged)
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		data[name] = value
+	}
+	return nil
+}
+
+// checkComputedWrite rejects update data setting a computed field.
+func checkComputedWrite(schema *CollectionSchema, data map[string]interface{}) error {
+	for _, field := range schema.Root.Fields {
+		if _, exists := data[field.JSONTag]; exists && field.SchemaType == "computed" {
+			return fmt.Errorf("The computed field %s can't be written", field.JSONTag)
+		}
+	}
+	return nil
+}
+
+// queryFields lists the fields a Mongo query refers to.
+func queryFields(query bson.M) []string {
+	var fields []string
+	for key, value := range query {
+		if !strings.HasPrefix(key, "$") {
+			fields = append(fields, key)
+			continue
+		}
+		switch conditions := value.(type) {
+		case []bson.M:
+			for _, condition := range conditions {
+				fields = append(fields, queryFields(condition)...)
+			}
+		case bson.A:
+			for _, condition := range conditions {
+				if nested, ok := condition.(bson.M); ok {
+					fields = append(fields, queryFields(nested)...)
+				}
+			}
+		}
+	}
+	return fields
+}
+
+// checkComputedQuery rejects filters and sorts on computed fields that aren't stored, since
+// the database doesn't know their values.
+func checkComputedQuery(schema *CollectionSchema, filter bson.M, sortFields ...string) error {
+	for _, field := range computedFields(schema, false) {
+		for _, name := range append(queryFields(filter), sortFields...) {
+			if name == field.JSONTag || strings.HasPrefix(name, field.JSONTag+".") {
+				return fmt.Errorf("The computed field %s isn't stored, it can't be used to filter or sort", field.JSONTag)
+			}
+		}
+	}
+	return nil
+}
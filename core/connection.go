@@ -0,0 +1,227 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lestrrat-go/backoff/v2"
+	"github.com/lodjim/naboobase/configs"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+type ConnectionState string
+
+const (
+	StateDisconnected ConnectionState = "disconnected"
+	StateConnected    ConnectionState = "connected"
+	StateUnreachable  ConnectionState = "unreachable"
+)
+
+type TLSOptions struct {
+	Enabled            bool
+	CAFile             string // PEM file of the certificate authorities to trust, the system ones when empty
+	CertificateFile    string // PEM file of the client certificate, for x.509 authentication
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+type ConnectionOptions struct {
+	URI                    string
+	MaxPoolSize            uint64
+	MinPoolSize            uint64
+	MaxConnIdleTime        time.Duration
+	ConnectTimeout         time.Duration // Timeout of every connection attempt
+	ServerSelectionTimeout time.Duration
+	SocketTimeout          time.Duration
+	ReadPreference         string // primary, primaryPreferred, secondary, secondaryPreferred or nearest
+	WriteConcern           string // "majority", a number of nodes or a tag set name
+	Journal                bool
+	TLS                    TLSOptions
+	MaxRetries             int // Connection attempts before giving up, a single one when lower than 1
+	RetryMinInterval       time.Duration
+	RetryMaxInterval       time.Duration
+}
+
+// DefaultConnectionOptions connects to MONGOURI with the settings naboobase always used.
+func DefaultConnectionOptions() ConnectionOptions {
+	return ConnectionOptions{
+		URI:              configs.EnvMongoURI(),
+		MaxPoolSize:      50,
+		MinPoolSize:      10,
+		MaxConnIdleTime:  10 * time.Minute,
+		ConnectTimeout:   10 * time.Second,
+		MaxRetries:       5,
+		RetryMinInterval: 500 * time.Millisecond,
+		RetryMaxInterval: 30 * time.Second,
+	}
+}
+
+func tlsConfig(tlsOptions TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: tlsOptions.InsecureSkipVerify}
+	if tlsOptions.CAFile != "" {
+		pem, err := os.ReadFile(tlsOptions.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", tlsOptions.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if tlsOptions.CertificateFile != "" {
+		certificate, err := tls.LoadX509KeyPair(tlsOptions.CertificateFile, tlsOptions.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// clientOptions translates connection options into the options of the driver.
+func clientOptions(connectionOptions ConnectionOptions) (*options.ClientOptions, error) {
+	clientOptions := options.Client().ApplyURI(connectionOptions.URI)
+	if connectionOptions.MaxPoolSize > 0 {
+		clientOptions.SetMaxPoolSize(connectionOptions.MaxPoolSize)
+	}
+	if connectionOptions.MinPoolSize > 0 {
+		clientOptions.SetMinPoolSize(connectionOptions.MinPoolSize)
+	}
+	if connectionOptions.MaxConnIdleTime > 0 {
+		clientOptions.SetMaxConnIdleTime(connectionOptions.MaxConnIdleTime)
+	}
+	if connectionOptions.ConnectTimeout > 0 {
+		clientOptions.SetConnectTimeout(connectionOptions.ConnectTimeout)
+	}
+	if connectionOptions.ServerSelectionTimeout > 0 {
+		clientOptions.SetServerSelectionTimeout(connectionOptions.ServerSelectionTimeout)
+	}
+	if connectionOptions.SocketTimeout > 0 {
+		clientOptions.SetSocketTimeout(connectionOptions.SocketTimeout)
+	}
+	if connectionOptions.ReadPreference != "" {
+		mode, err := readpref.ModeFromString(connectionOptions.ReadPreference)
+		if err != nil {
+			return nil, err
+		}
+		preference, err := readpref.New(mode)
+		if err != nil {
+			return nil, err
+		}
+		clientOptions.SetReadPreference(preference)
+	}
+	if connectionOptions.WriteConcern != "" || connectionOptions.Journal {
+		concern := &writeconcern.WriteConcern{}
+		if nodes, err := strconv.Atoi(connectionOptions.WriteConcern); err == nil {
+			concern.W = nodes
+		} else if connectionOptions.WriteConcern != "" {
+			concern.W = connectionOptions.WriteConcern
+		}
+		if connectionOptions.Journal {
+			journal := true
+			concern.Journal = &journal
+		}
+		clientOptions.SetWriteConcern(concern)
+	}
+	if connectionOptions.TLS.Enabled {
+		config, err := tlsConfig(connectionOptions.TLS)
+		if err != nil {
+			return nil, err
+		}
+		clientOptions.SetTLSConfig(config)
+	}
+	return clientOptions, clientOptions.Validate()
+}
+
+// ConnectWithOptions connects to the database, retrying with an exponential backoff while
+// the server can't be reached.
+func (db *MongoDBconnector) ConnectWithOptions(DBName string, connectionOptions ConnectionOptions) error {
+	clientOptions, err := clientOptions(connectionOptions)
+	if err != nil {
+		return fmt.Errorf("invalid connection options: %w", err)
+	}
+	attemptTimeout := connectionOptions.ConnectTimeout
+	if attemptTimeout <= 0 {
+		attemptTimeout = 10 * time.Second
+	}
+	if connectionOptions.MaxRetries < 1 {
+		client, err := connectOnce(clientOptions, attemptTimeout)
+		if err != nil {
+			return fmt.Errorf("Error during the database connection: %w", err)
+		}
+		db.DBName = DBName
+		db.Client = client
+		fmt.Println("Connected to MongoDB")
+		return nil
+	}
+	policy := backoff.Exponential(
+		backoff.WithMinInterval(connectionOptions.RetryMinInterval),
+		backoff.WithMaxInterval(connectionOptions.RetryMaxInterval),
+		backoff.WithJitterFactor(0.1),
+		backoff.WithMaxRetries(connectionOptions.MaxRetries),
+	)
+
+	// Stops the backoff controller once connected
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	retries := policy.Start(ctx)
+	attempt := 0
+	for backoff.Continue(retries) {
+		attempt++
+		var client *mongo.Client
+		client, err = connectOnce(clientOptions, attemptTimeout)
+		if err == nil {
+			db.DBName = DBName
+			db.Client = client
+			fmt.Println("Connected to MongoDB")
+			return nil
+		}
+		fmt.Printf("Connection attempt %d to MongoDB failed: %s\n", attempt, err.Error())
+	}
+	return fmt.Errorf("Error during the database connection after %d attempts: %w", attempt, err)
+}
+
+func connectOnce(clientOptions *options.ClientOptions, timeout time.Duration) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, err
+	}
+	return client, nil
+}
+
+// Close disconnects from the database, waiting for the operations in progress until ctx ends.
+func (db *MongoDBconnector) Close(ctx context.Context) error {
+	if db.Client == nil {
+		return nil
+	}
+	return db.Client.Disconnect(ctx)
+}
+
+// State tells whether the connector is connected and the database answers.
+func (db *MongoDBconnector) State(ctx context.Context) ConnectionState {
+	if db.Client == nil {
+		return StateDisconnected
+	}
+	if err := db.Client.Ping(ctx, nil); err != nil {
+		if err == mongo.ErrClientDisconnected {
+			return StateDisconnected
+		}
+		return StateUnreachable
+	}
+	return StateConnected
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/lodjim/naboobase/configs"
 	"github.com/lodjim/naboobase/utils"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -30,9 +29,13 @@ type MongoDBconnector struct {
 }
 
 func isFieldUnique(ctx context.Context, collection *mongo.Collection, field string, value interface{}) (bool, error) {
-	filter := bson.M{field: value}
+	// Encrypted values are looked up under every key, a rotation may not be done
+	filter, err := encryptFilter(collection.Name(), bson.M{field: value})
+	if err != nil {
+		return false, err
+	}
 	var result bson.M
-	err := collection.FindOne(ctx, filter).Decode(&result)
+	err = collection.FindOne(ctx, filter).Decode(&result)
 	if err == mongo.ErrNoDocuments {
 		return true, nil
 	} else if err != nil {
@@ -65,25 +68,67 @@ func isUnique(ctx context.Context, collection *mongo.Collection, record interfac
 	return nil
 }
 
+// isEncryptedUnique returns an error when an encrypted field marked unique of the record is
+// already used by another record than except. Their uniqueness comes from the schema, their
+// model tag being db:"encrypted".
+func isEncryptedUnique(ctx context.Context, collection *mongo.Collection, record interface{}, except primitive.ObjectID) error {
+	fields, err := encryptedFields(collection.Name())
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+	document, err := toDocument(record)
+	if err != nil {
+		return err
+	}
+	for name, field := range fields {
+		value, ok := document[name]
+		if !field.Unique || !ok || value == nil {
+			continue
+		}
+		filter, err := encryptFilter(collection.Name(), bson.M{name: value})
+		if err != nil {
+			return err
+		}
+		if !except.IsZero() {
+			filter["_id"] = bson.M{"$ne": except}
+		}
+		err = collection.FindOne(ctx, filter).Err()
+		if err == nil {
+			return fmt.Errorf("For the Field: %s the value is already in the database", field.Name)
+		}
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+	return nil
+}
+
 func (db *MongoDBconnector) DeleteRecordById(ctx context.Context, collectionName string, id primitive.ObjectID, record interface{}) error {
 	collection := db.Client.Database(db.DBName).Collection(collectionName)
 	res, err := collection.DeleteOne(ctx, bson.M{"_id": id})
-	if res.DeletedCount == 0 {
-		return fmt.Errorf("Not %s found in the database", id.Hex())
-	}
 	if err != nil {
 		return err
 	}
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("Not %s found in the database", id.Hex())
+	}
 	return nil
 }
 
 func (db *MongoDBconnector) GetRecord(ctx context.Context, collectionName string, filter interface{}, record interface{}) error {
 	collection := db.Client.Database(db.DBName).Collection(collectionName)
-	err := collection.FindOne(ctx, filter).Decode(record)
+	if query, ok := filter.(bson.M); ok {
+		encrypted, err := encryptFilter(collectionName, query)
+		if err != nil {
+			return err
+		}
+		filter = encrypted
+	}
+	raw, err := collection.FindOne(ctx, filter).Raw()
 	if err != nil {
 		return err
 	}
-	return nil
+	return decodeDecrypted(collectionName, raw, record)
 }
 
 func (db *MongoDBconnector) CreateRecord(ctx context.Context, collectionName string, record interface{}) error {
@@ -92,6 +137,9 @@ func (db *MongoDBconnector) CreateRecord(ctx context.Context, collectionName str
 	if err != nil {
 		return err
 	}
+	if err := isEncryptedUnique(ctx, collection, record, primitive.NilObjectID); err != nil {
+		return err
+	}
 
 	fields := utils.GetTaggedFields(record, "autogenerate")
 	for _, field := range fields {
@@ -101,29 +149,20 @@ func (db *MongoDBconnector) CreateRecord(ctx context.Context, collectionName str
 		}
 	}
 
-	_, err = collection.InsertOne(ctx, record)
+	document, err := sealedRecord(collectionName, record)
+	if err != nil {
+		return err
+	}
+	_, err = collection.InsertOne(ctx, document)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Connect connects to the database of MONGOURI with the default connection options.
 func (db *MongoDBconnector) Connect(DBName string) error {
-	db.DBName = DBName
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	var err error
-	db.Client, err = mongo.Connect(ctx, options.Client().ApplyURI(configs.EnvMongoURI()).SetMaxPoolSize(50).SetMinPoolSize(10).SetMaxConnIdleTime(10*time.Minute))
-	if err != nil {
-		return err
-	}
-	err = db.Client.Ping(ctx, nil)
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	fmt.Println("Connected to MongoDB")
-	return errors.New("Error during the database connection")
+	return db.ConnectWithOptions(DBName, DefaultConnectionOptions())
 }
 
 func (db *MongoDBconnector) UpdateRecord(
@@ -138,18 +177,88 @@ func (db *MongoDBconnector) UpdateRecord(
 	if err := isUnique(ctx, collection, updateData, "unique"); err != nil {
 		return err
 	}
+	if err := isEncryptedUnique(ctx, collection, updateData, id); err != nil {
+		return err
+	}
 
-	update := bson.M{"$set": updateData}
+	sealed, err := sealedRecord(collectionName, updateData)
+	if err != nil {
+		return err
+	}
+	update := bson.M{"$set": sealed}
 	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
 
-	err := collection.FindOneAndUpdate(
+	raw, err := collection.FindOneAndUpdate(
 		ctx,
 		bson.M{"_id": id},
 		update,
 		opts,
-	).Decode(record)
+	).Raw()
+	if err != nil {
+		return err
+	}
+	return decodeDecrypted(collectionName, raw, record)
+}
 
-	return err
+// bulkDocuments checks the unique fields of records, against the collection and each other,
+// generates their IDs and returns them as the documents to insert.
+func bulkDocuments(ctx context.Context, collection *mongo.Collection, records []interface{}) ([]interface{}, error) {
+	collectionName := collection.Name()
+	encrypted, err := encryptedFields(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, record := range records {
+		if err := isUnique(ctx, collection, record, "unique"); err != nil {
+			return nil, err
+		}
+		if err := isEncryptedUnique(ctx, collection, record, primitive.NilObjectID); err != nil {
+			return nil, err
+		}
+		document, err := toDocument(record)
+		if err != nil {
+			return nil, err
+		}
+		for name, field := range encrypted {
+			if value, ok := document[name]; ok && value != nil && field.Unique {
+				key := fmt.Sprintf("%s=%v", name, value)
+				if seen[key] {
+					return nil, fmt.Errorf("For the Field: %s a value is used more than once", field.Name)
+				}
+				seen[key] = true
+			}
+		}
+		for _, field := range utils.GetTaggedFields(record, "unique") {
+			value, err := utils.Get(field, record)
+			if err != nil {
+				return nil, err
+			}
+			key := fmt.Sprintf("%s=%v", field, value)
+			if seen[key] {
+				return nil, fmt.Errorf("For the Field: %s the value %v is used more than once", field, value)
+			}
+			seen[key] = true
+		}
+		for _, field := range utils.GetTaggedFields(record, "autogenerate") {
+			// Records coming from an import keep their ID
+			if value, err := utils.Get(field, record); err == nil && value != primitive.NilObjectID {
+				continue
+			}
+			if err := utils.Set(field, primitive.NewObjectID(), record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	documents := make([]interface{}, len(records))
+	for i, record := range records {
+		document, err := sealedRecord(collectionName, record)
+		if err != nil {
+			return nil, err
+		}
+		documents[i] = document
+	}
+	return documents, nil
 }
 
 func (db *MongoDBconnector) BulkCreateRecords(
@@ -159,15 +268,90 @@ func (db *MongoDBconnector) BulkCreateRecords(
 ) error {
 
 	collection := db.Client.Database(db.DBName).Collection(collectionName)
-	for _, record := range records {
-		if err := isUnique(ctx, collection, record, "unique"); err != nil {
-			return err
-		}
+	documents, err := bulkDocuments(ctx, collection, records)
+	if err != nil {
+		return err
 	}
-	_, err := collection.InsertMany(ctx, records)
+	_, err = collection.InsertMany(ctx, documents)
 	return err
 }
 
+// ImportRecords creates records like BulkCreateRecords, but doesn't stop at the first one the
+// database refuses: failed maps the index of every refused record to its error.
+func (db *MongoDBconnector) ImportRecords(
+	ctx context.Context,
+	collectionName string,
+	records []interface{},
+) (map[int]error, error) {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	documents, err := bulkDocuments(ctx, collection, records)
+	if err != nil {
+		return nil, err
+	}
+	_, err = collection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		failed := make(map[int]error, len(bulkErr.WriteErrors))
+		for _, writeErr := range bulkErr.WriteErrors {
+			failed[writeErr.Index] = writeErr
+		}
+		return failed, nil
+	}
+	return nil, err
+}
+
+func (db *MongoDBconnector) UpdateManyRecords(
+	ctx context.Context,
+	collectionName string,
+	filter bson.M,
+	updateData interface{},
+) (int64, error) {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	filter, err := encryptFilter(collectionName, filter)
+	if err != nil {
+		return 0, err
+	}
+	sealed, err := sealedRecord(collectionName, updateData)
+	if err != nil {
+		return 0, err
+	}
+	res, err := collection.UpdateMany(ctx, filter, bson.M{"$set": sealed})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+func (db *MongoDBconnector) DeleteManyRecords(
+	ctx context.Context,
+	collectionName string,
+	filter bson.M,
+) (int64, error) {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	filter, err := encryptFilter(collectionName, filter)
+	if err != nil {
+		return 0, err
+	}
+	res, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (db *MongoDBconnector) CountRecords(
+	ctx context.Context,
+	collectionName string,
+	filter bson.M,
+) (int64, error) {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	filter, err := encryptFilter(collectionName, filter)
+	if err != nil {
+		return 0, err
+	}
+	return collection.CountDocuments(ctx, filter)
+}
+
 func (db *MongoDBconnector) SoftDeleteRecord(
 	ctx context.Context,
 	collectionName string,
@@ -185,11 +369,15 @@ func (db *MongoDBconnector) GetPaginatedRecords(
 	filter bson.M,
 	page int64,
 	limit int64,
-	sortField string,
-	sortOrder int,
+	sort bson.D,
+	projection bson.M,
 	results *[]map[string]interface{},
 ) (int64, error) {
 	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	filter, err := encryptFilter(collectionName, filter)
+	if err != nil {
+		return 0, err
+	}
 
 	total, err := collection.CountDocuments(ctx, filter)
 	if err != nil {
@@ -199,7 +387,10 @@ func (db *MongoDBconnector) GetPaginatedRecords(
 	opts := options.Find().
 		SetSkip((page - 1) * limit).
 		SetLimit(limit).
-		SetSort(bson.D{{sortField, sortOrder}})
+		SetSort(sort)
+	if projection != nil {
+		opts.SetProjection(projection)
+	}
 
 	cursor, err := collection.Find(ctx, filter, opts)
 	if err != nil {
@@ -207,7 +398,187 @@ func (db *MongoDBconnector) GetPaginatedRecords(
 	}
 	defer cursor.Close(ctx)
 
-	return total, cursor.All(ctx, results)
+	if err := cursor.All(ctx, results); err != nil {
+		return 0, err
+	}
+	return total, decryptResults(collectionName, *results)
+}
+
+// GetPaginatedJoinedRecords pages through the records matching a filter once the joins stages
+// looked their related records up. The related records aren't returned.
+func (db *MongoDBconnector) GetPaginatedJoinedRecords(
+	ctx context.Context,
+	collectionName string,
+	joins []bson.M,
+	filter bson.M,
+	page int64,
+	limit int64,
+	sort bson.D,
+	results *[]map[string]interface{},
+) (int64, error) {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	filter, err := encryptFilter(collectionName, filter)
+	if err != nil {
+		return 0, err
+	}
+	match := joinedMatch(joins, filter)
+
+	var counts []struct {
+		Total int64 `bson:"total"`
+	}
+	cursor, err := collection.Aggregate(ctx, append(append([]bson.M{}, match...), bson.M{"$count": "total"}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &counts); err != nil {
+		return 0, err
+	}
+	var total int64
+	if len(counts) > 0 {
+		total = counts[0].Total
+	}
+
+	records, err := collection.Aggregate(ctx, joinedPage(match, page, limit, sort))
+	if err != nil {
+		return 0, err
+	}
+	defer records.Close(ctx)
+	if err := records.All(ctx, results); err != nil {
+		return 0, err
+	}
+	return total, decryptResults(collectionName, *results)
+}
+
+// Explain returns how the database runs a find or an aggregate command.
+func (db *MongoDBconnector) Explain(ctx context.Context, command bson.D) (bson.M, error) {
+	var result bson.M
+	explain := bson.D{{Key: "explain", Value: command}, {Key: "verbosity", Value: "executionStats"}}
+	err := db.Client.Database(db.DBName).RunCommand(ctx, explain).Decode(&result)
+	return result, err
+}
+
+func (db *MongoDBconnector) Aggregate(
+	ctx context.Context,
+	collectionName string,
+	pipeline interface{},
+	results interface{},
+) error {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	return cursor.All(ctx, results)
+}
+
+// GetPaginatedNearRecords pages through the records matching the filter from the closest to
+// the farthest from point, storing the distance in meters under distanceFieldName.
+func (db *MongoDBconnector) GetPaginatedNearRecords(
+	ctx context.Context,
+	collectionName string,
+	filter bson.M,
+	field string,
+	point bson.A,
+	distanceFieldName string,
+	page int64,
+	limit int64,
+	results *[]map[string]interface{},
+) (int64, error) {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	filter, err := encryptFilter(collectionName, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	pipeline := []bson.M{
+		{"$geoNear": bson.M{
+			"near":          bson.M{"type": "Point", "coordinates": point},
+			"distanceField": distanceFieldName,
+			"key":           field,
+			"spherical":     true,
+			"query":         filter,
+		}},
+		{"$skip": (page - 1) * limit},
+		{"$limit": limit},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	if err := cursor.All(ctx, results); err != nil {
+		return 0, err
+	}
+	return total, decryptResults(collectionName, *results)
+}
+
+// CheckUnique returns an error when a field tagged unique of the record, or an encrypted field
+// marked unique in the schema, is already used.
+func (db *MongoDBconnector) CheckUnique(ctx context.Context, collectionName string, record interface{}) error {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	if err := isUnique(ctx, collection, record, "unique"); err != nil {
+		return err
+	}
+	return isEncryptedUnique(ctx, collection, record, primitive.NilObjectID)
+}
+
+// IterateRecords calls fn on every record matching the filter, stopping at the first error.
+func (db *MongoDBconnector) IterateRecords(
+	ctx context.Context,
+	collectionName string,
+	filter bson.M,
+	fn func(record bson.M) error,
+	opts ...*options.FindOptions,
+) error {
+	fields, err := encryptedFields(collectionName)
+	if err != nil {
+		return err
+	}
+	filter, err = encryptFilter(collectionName, filter)
+	if err != nil {
+		return err
+	}
+	return db.IterateRawRecords(ctx, collectionName, filter, func(record bson.M) error {
+		if err := decryptFields(fields, record); err != nil {
+			return err
+		}
+		return fn(record)
+	}, opts...)
+}
+
+// IterateRawRecords calls fn on every document matching the filter as it is stored, with
+// its encrypted fields sealed.
+func (db *MongoDBconnector) IterateRawRecords(
+	ctx context.Context,
+	collectionName string,
+	filter bson.M,
+	fn func(record bson.M) error,
+	opts ...*options.FindOptions,
+) error {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	cursor, err := collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var record bson.M
+		if err := cursor.Decode(&record); err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
 }
 
 func (db *MongoDBconnector) ExistsRecord(
@@ -230,6 +601,96 @@ func (db *MongoDBconnector) EnsureIndexes(
 	return err
 }
 
+func (db *MongoDBconnector) DropIndex(
+	ctx context.Context,
+	collectionName string,
+	name string,
+) error {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	_, err := collection.Indexes().DropOne(ctx, name)
+	return err
+}
+
+func (db *MongoDBconnector) ListCollections(ctx context.Context) ([]string, error) {
+	return db.Client.Database(db.DBName).ListCollectionNames(ctx, bson.M{})
+}
+
+// ListIndexes returns the definitions of the indexes of a collection, in the order of their
+// keys, which compound indexes depend on.
+func (db *MongoDBconnector) ListIndexes(ctx context.Context, collectionName string) ([]bson.D, error) {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var indexes []bson.D
+	return indexes, cursor.All(ctx, &indexes)
+}
+
+// CreateIndexSpecs creates indexes from raw definitions, as returned by ListIndexes.
+func (db *MongoDBconnector) CreateIndexSpecs(ctx context.Context, collectionName string, specs []bson.D) error {
+	command := bson.D{
+		{Key: "createIndexes", Value: collectionName},
+		{Key: "indexes", Value: specs},
+	}
+	return db.Client.Database(db.DBName).RunCommand(ctx, command).Err()
+}
+
+// IncrementCounter adds one to the counter of a collection of counters whose _id is key, and
+// returns its new value. ok is false when the counter doesn't exist.
+func (db *MongoDBconnector) IncrementCounter(ctx context.Context, collectionName string, key interface{}) (int64, bool, error) {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	var counter struct {
+		Value int64 `bson:"value"`
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, bson.M{"$inc": bson.M{"value": 1}}, opts).Decode(&counter)
+	if err == mongo.ErrNoDocuments {
+		return 0, false, nil
+	}
+	return counter.Value, err == nil, err
+}
+
+// CreateCounter creates the counter of a collection of counters whose _id is key with a
+// value, unless it exists.
+func (db *MongoDBconnector) CreateCounter(ctx context.Context, collectionName string, key interface{}, value int64) error {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	opts := options.Update().SetUpsert(true)
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": key}, bson.M{"$setOnInsert": bson.M{"value": value}}, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		// Created by a concurrent write
+		return nil
+	}
+	return err
+}
+
+func (db *MongoDBconnector) DropCollection(ctx context.Context, collectionName string) error {
+	return db.Client.Database(db.DBName).Collection(collectionName).Drop(ctx)
+}
+
+func (db *MongoDBconnector) CreateCollection(ctx context.Context, collectionName string) error {
+	return db.Client.Database(db.DBName).CreateCollection(ctx, collectionName)
+}
+
+// RenameCollection renames a collection, with its documents and indexes, replacing the
+// collection named to when it exists.
+func (db *MongoDBconnector) RenameCollection(ctx context.Context, from string, to string) error {
+	command := bson.D{
+		{Key: "renameCollection", Value: db.DBName + "." + from},
+		{Key: "to", Value: db.DBName + "." + to},
+		{Key: "dropTarget", Value: true},
+	}
+	return db.Client.Database("admin").RunCommand(ctx, command).Err()
+}
+
+// InsertRecords inserts documents as they are, without uniqueness checks nor generated IDs.
+func (db *MongoDBconnector) InsertRecords(ctx context.Context, collectionName string, records []interface{}) error {
+	collection := db.Client.Database(db.DBName).Collection(collectionName)
+	_, err := collection.InsertMany(ctx, records)
+	return err
+}
+
 func (db *MongoDBconnector) WithTransaction(
 	ctx context.Context,
 	fn func(sessCtx mongo.SessionContext) (interface{}, error),
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lodjim/naboobase/utils"
+)
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
+
+// resolveDefault returns the value of a default, evaluating the macros it may be.
+func resolveDefault(value interface{}, claims *utils.Claims) (interface{}, error) {
+	macro, ok := value.(string)
+	if !ok || !strings.HasPrefix(macro, "@") {
+		return value, nil
+	}
+	switch macro {
+	case "@now":
+		return time.Now().UTC(), nil
+	case "@uuid":
+		return newUUID()
+	case "@request.auth.id", "@request.auth.email":
+		if claims == nil || claims.Id == "" {
+			return nil, errors.New("Unauthorized: authentication required")
+		}
+		if macro == "@request.auth.id" {
+			return claims.Id, nil
+		}
+		return claims.Email, nil
+	default:
+		return nil, fmt.Errorf("unsupported default: %s", macro)
+	}
+}
+
+// defaultValues returns the defaults of the fields missing from a create payload.
+func defaultValues(schema *CollectionSchema, claims *utils.Claims, payload map[string]interface{}) (map[string]interface{}, error) {
+	defaults := make(map[string]interface{})
+	for _, field := range schema.Root.Fields {
+		if field.Default == nil {
+			continue
+		}
+		if value, sent := payload[field.JSONTag]; sent && value != nil {
+			continue
+		}
+		value, err := resolveDefault(field.Default, claims)
+		if err != nil {
+			return nil, fmt.Errorf("the default of %s: %w", field.JSONTag, err)
+		}
+		defaults[field.JSONTag] = value
+	}
+	return defaults, nil
+}
+
+// checkReadOnly rejects a payload setting a field clients aren't allowed to write.
+func checkReadOnly(schema *CollectionSchema, payload map[string]interface{}) error {
+	for _, field := range schema.Root.Fields {
+		if _, sent := payload[field.JSONTag]; !sent {
+			continue
+		}
+		if field.ReadOnly {
+			return fmt.Errorf("The field %s is read-only", field.JSONTag)
+		}
+		if field.Hidden {
+			return fmt.Errorf("The field %s is hidden, it is managed by the server", field.JSONTag)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,516 @@
+package core
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/lodjim/naboobase/configs"
+	"github.com/lodjim/naboobase/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Encrypted values are stored as "enc:<key id>:<base64 of the nonce and the ciphertext>"
+const encryptedPrefix = "enc:"
+
+// errEncryptedFilter is returned for the filters an encrypted field can't answer.
+var errEncryptedFilter = errors.New("encrypted field")
+
+type encryptionKey struct {
+	id    string
+	aead  cipher.AEAD
+	nonce []byte // Key of the HMAC deriving the nonces of deterministic values
+}
+
+var (
+	encryptionKeysOnce sync.Once
+	encryptionKeyRing  []encryptionKey
+	encryptionKeysErr  error
+)
+
+func parseEncryptionKey(encoded string) (encryptionKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return encryptionKey{}, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	if len(raw) != 32 {
+		return encryptionKey{}, fmt.Errorf("invalid encryption key: expected 32 bytes, got %d", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return encryptionKey{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return encryptionKey{}, err
+	}
+	id := sha256.Sum256(raw)
+	nonce := sha256.Sum256(append([]byte("naboobase-nonce:"), raw...))
+	return encryptionKey{id: hex.EncodeToString(id[:4]), aead: aead, nonce: nonce[:]}, nil
+}
+
+// encryptionKeys returns the current key followed by the previous ones, read once from the
+// configuration.
+func encryptionKeys() ([]encryptionKey, error) {
+	encryptionKeysOnce.Do(func() {
+		current := configs.GetEncryptionKey()
+		if current == "" {
+			encryptionKeysErr = errors.New("ENCRYPTION_KEY is not set, it is needed by the encrypted fields")
+			return
+		}
+		for _, encoded := range append([]string{current}, configs.GetPreviousEncryptionKeys()...) {
+			key, err := parseEncryptionKey(encoded)
+			if err != nil {
+				encryptionKeysErr = err
+				return
+			}
+			encryptionKeyRing = append(encryptionKeyRing, key)
+		}
+	})
+	return encryptionKeyRing, encryptionKeysErr
+}
+
+// encryptedFields returns the fields of an auto-served collection stored encrypted, by json
+// name. Only top-level fields can be encrypted. Without its schema nothing can be read nor
+// written, rather than letting the fields through in plaintext.
+func encryptedFields(collection string) (map[string]utils.FieldDefinition, error) {
+	if _, ok := HandlerConfigRegistry[collection]; !ok {
+		return nil, nil
+	}
+	schema, err := loadSchema(collection)
+	if err != nil {
+		return nil, fmt.Errorf("the encrypted fields of %s: %w", collection, err)
+	}
+	var fields map[string]utils.FieldDefinition
+	for _, field := range schema.Root.Fields {
+		if field.Encryption == "" {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]utils.FieldDefinition)
+		}
+		fields[field.JSONTag] = field
+	}
+	return fields, nil
+}
+
+// encryptValue seals a value with a key. The field name is authenticated with it, so a value
+// can't be moved to another field. Deterministic values derive their nonce from the
+// plaintext, the same value always gives the same ciphertext.
+func encryptValue(key encryptionKey, field string, value interface{}, deterministic bool) (string, error) {
+	plaintext, err := bson.Marshal(bson.D{{Key: "v", Value: value}})
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, key.aead.NonceSize())
+	if deterministic {
+		mac := hmac.New(sha256.New, key.nonce)
+		mac.Write([]byte(field))
+		mac.Write([]byte{0})
+		mac.Write(plaintext)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := key.aead.Seal(nonce, nonce, plaintext, []byte(field))
+	return encryptedPrefix + key.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptValue opens a value sealed by encryptValue. Values that aren't encrypted, written
+// before the field was, are returned as they are.
+func decryptValue(field string, value interface{}) (interface{}, error) {
+	encoded, ok := value.(string)
+	if !ok || !strings.HasPrefix(encoded, encryptedPrefix) {
+		return value, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(encoded, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("the value of %s is not a valid encrypted value", field)
+	}
+	keys, err := encryptionKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.id != parts[0] {
+			continue
+		}
+		sealed, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(sealed) < key.aead.NonceSize() {
+			return nil, fmt.Errorf("the value of %s is not a valid encrypted value", field)
+		}
+		nonceSize := key.aead.NonceSize()
+		plaintext, err := key.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(field))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", field, err)
+		}
+		var decoded bson.M
+		if err := bson.Unmarshal(plaintext, &decoded); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", field, err)
+		}
+		return decoded["v"], nil
+	}
+	return nil, fmt.Errorf("the value of %s is encrypted with the unknown key %s", field, parts[0])
+}
+
+func isCurrentlyEncrypted(value interface{}, keys []encryptionKey) bool {
+	encoded, ok := value.(string)
+	return ok && strings.HasPrefix(encoded, encryptedPrefix+keys[0].id+":")
+}
+
+// encryptDocument returns a copy of a document whose encrypted fields are sealed with the
+// current key.
+func encryptDocument(collection string, record interface{}) (bson.M, error) {
+	fields, err := encryptedFields(collection)
+	if err != nil {
+		return nil, err
+	}
+	document, err := toDocument(record)
+	if err != nil {
+		return nil, err
+	}
+	return encryptFields(fields, document)
+}
+
+// sealedRecord returns what to write for a record, itself when its collection has no
+// encrypted field.
+func sealedRecord(collection string, record interface{}) (interface{}, error) {
+	fields, err := encryptedFields(collection)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return record, nil
+	}
+	document, err := toDocument(record)
+	if err != nil {
+		return nil, err
+	}
+	return encryptFields(fields, document)
+}
+
+func encryptFields(fields map[string]utils.FieldDefinition, document bson.M) (bson.M, error) {
+	if len(fields) == 0 {
+		return document, nil
+	}
+	keys, err := encryptionKeys()
+	if err != nil {
+		return nil, err
+	}
+	encrypted := make(bson.M, len(document))
+	for name, value := range document {
+		field, ok := fields[name]
+		if !ok || value == nil {
+			encrypted[name] = value
+			continue
+		}
+		if encrypted[name], err = encryptValue(keys[0], name, value, field.Encryption == "deterministic"); err != nil {
+			return nil, err
+		}
+	}
+	return encrypted, nil
+}
+
+// decryptDocument opens in place the encrypted fields of a document read from a collection.
+func decryptDocument(collection string, document map[string]interface{}) error {
+	fields, err := encryptedFields(collection)
+	if err != nil {
+		return err
+	}
+	return decryptFields(fields, document)
+}
+
+func decryptFields(fields map[string]utils.FieldDefinition, document map[string]interface{}) error {
+	for name := range fields {
+		value, ok := document[name]
+		if !ok {
+			continue
+		}
+		decrypted, err := decryptValue(name, value)
+		if err != nil {
+			return err
+		}
+		document[name] = decrypted
+	}
+	return nil
+}
+
+// decryptResults opens the encrypted fields of the documents read from a collection.
+func decryptResults(collection string, results []map[string]interface{}) error {
+	fields, err := encryptedFields(collection)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if err := decryptFields(fields, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeDecrypted decodes a raw document into record once its encrypted fields are opened.
+func decodeDecrypted(collection string, raw bson.Raw, record interface{}) error {
+	fields, err := encryptedFields(collection)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return bson.Unmarshal(raw, record)
+	}
+	var document bson.M
+	if err := bson.Unmarshal(raw, &document); err != nil {
+		return err
+	}
+	if err := decryptFields(fields, document); err != nil {
+		return err
+	}
+	encoded, err := bson.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(encoded, record)
+}
+
+// encryptFilter rewrites the conditions on deterministic encrypted fields to match their
+// ciphertexts under every key. Equality is all they can answer, and randomized fields can't
+// be filtered at all.
+func encryptFilter(collection string, filter bson.M) (bson.M, error) {
+	fields, err := encryptedFields(collection)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 || len(filter) == 0 {
+		return filter, nil
+	}
+	keys, err := encryptionKeys()
+	if err != nil {
+		return nil, err
+	}
+	return encryptConditions(fields, keys, filter)
+}
+
+func encryptConditions(fields map[string]utils.FieldDefinition, keys []encryptionKey, filter bson.M) (bson.M, error) {
+	rewritten := make(bson.M, len(filter))
+	for key, value := range filter {
+		switch key {
+		case "$and", "$or", "$nor":
+			var clauses []interface{}
+			switch list := value.(type) {
+			case []bson.M:
+				for _, clause := range list {
+					clauses = append(clauses, clause)
+				}
+			case bson.A:
+				clauses = list
+			case []interface{}:
+				clauses = list
+			default:
+				rewritten[key] = value
+				continue
+			}
+			encrypted := make([]bson.M, 0, len(clauses))
+			for _, clause := range clauses {
+				condition, ok := clause.(bson.M)
+				if !ok {
+					return nil, fmt.Errorf("unexpected %s clause %v", key, clause)
+				}
+				condition, err := encryptConditions(fields, keys, condition)
+				if err != nil {
+					return nil, err
+				}
+				encrypted = append(encrypted, condition)
+			}
+			rewritten[key] = encrypted
+			continue
+		}
+		field, ok := fields[key]
+		if !ok {
+			rewritten[key] = value
+			continue
+		}
+		if field.Encryption != "deterministic" {
+			return nil, fmt.Errorf("%w: %s can't be used in a filter", errEncryptedFilter, key)
+		}
+		condition, err := encryptCondition(key, keys, value)
+		if err != nil {
+			return nil, err
+		}
+		rewritten[key] = condition
+	}
+	return rewritten, nil
+}
+
+// encryptCondition turns an equality on a deterministic field into an $in, and an inequality
+// into a $nin, over the ciphertexts of the values under every key.
+func encryptCondition(field string, keys []encryptionKey, value interface{}) (interface{}, error) {
+	operators, ok := value.(bson.M)
+	if !ok {
+		operators = bson.M{"$eq": value}
+	}
+	var in, notIn []interface{}
+	for operator, operand := range operators {
+		values := []interface{}{operand}
+		if operator == "$in" || operator == "$nin" {
+			switch list := operand.(type) {
+			case bson.A:
+				values = list
+			case []interface{}:
+				values = list
+			}
+		}
+		var ciphertexts []interface{}
+		for _, plain := range values {
+			for _, key := range keys {
+				ciphertext, err := encryptValue(key, field, plain, true)
+				if err != nil {
+					return nil, err
+				}
+				ciphertexts = append(ciphertexts, ciphertext)
+			}
+		}
+		switch operator {
+		case "$eq", "$in":
+			in = append(in, ciphertexts...)
+		case "$ne", "$nin":
+			notIn = append(notIn, ciphertexts...)
+		default:
+			return nil, fmt.Errorf("%w: %s only supports equality filters", errEncryptedFilter, field)
+		}
+	}
+	condition := bson.M{}
+	if in != nil {
+		condition["$in"] = in
+	}
+	if notIn != nil {
+		condition["$nin"] = notIn
+	}
+	return condition, nil
+}
+
+// ensureEncryptionIndexes enforces the uniqueness of the deterministic encrypted fields marked
+// unique, the ciphertexts being unique whenever the values are.
+func ensureEncryptionIndexes(ctx context.Context, db MongoDBconnector, collection string) error {
+	fields, err := encryptedFields(collection)
+	if err != nil {
+		return err
+	}
+	for name, field := range fields {
+		if field.Encryption != "deterministic" || !field.Unique {
+			continue
+		}
+		err := db.EnsureIndexes(ctx, collection, mongo.IndexModel{
+			Keys:    bson.D{{Key: name, Value: 1}},
+			Options: options.Index().SetUnique(true).SetSparse(true),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// needsRotation tells whether some encrypted field of a document isn't sealed with the
+// current key, either written with a previous key or before the field was encrypted.
+func needsRotation(fields map[string]utils.FieldDefinition, keys []encryptionKey, document bson.M) bool {
+	for name := range fields {
+		if value, ok := document[name]; ok && value != nil && !isCurrentlyEncrypted(value, keys) {
+			return true
+		}
+	}
+	return false
+}
+
+// RotateEncryptionKeys re-encrypts with the current ENCRYPTION_KEY the values sealed with one
+// of the ENCRYPTION_PREVIOUS_KEYS, in the records and their history. It returns the number of
+// documents rewritten, the previous keys can be dropped once it succeeds.
+func RotateEncryptionKeys(ctx context.Context, db MongoDBconnector) (int, error) {
+	rotated := 0
+	for collection := range HandlerConfigRegistry {
+		fields, err := encryptedFields(collection)
+		if err != nil {
+			return rotated, err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		keys, err := encryptionKeys()
+		if err != nil {
+			return rotated, err
+		}
+
+		var stale []bson.M
+		err = db.IterateRawRecords(ctx, collection, bson.M{}, func(record bson.M) error {
+			if needsRotation(fields, keys, record) {
+				stale = append(stale, record)
+			}
+			return nil
+		})
+		if err != nil {
+			return rotated, err
+		}
+		for _, record := range stale {
+			id, _ := record["_id"].(primitive.ObjectID)
+			update := bson.M{}
+			for name := range fields {
+				if value, ok := record[name]; ok {
+					decrypted, err := decryptValue(name, value)
+					if err != nil {
+						return rotated, fmt.Errorf("%s %s: %w", collection, id.Hex(), err)
+					}
+					update[name] = decrypted
+				}
+			}
+			// UpdateRecord encrypts the plain values with the current key
+			var updated bson.M
+			if err := db.UpdateRecord(ctx, collection, id, update, &updated); err != nil {
+				return rotated, fmt.Errorf("%s %s: %w", collection, id.Hex(), err)
+			}
+			rotated++
+		}
+
+		var modelConfig ModelConfig
+		if err := loadConfig(collection, &modelConfig); err != nil || !modelConfig.ContentConfigs.History {
+			continue
+		}
+		var staleEntries []bson.M
+		err = db.IterateRawRecords(ctx, historyCollection(collection), bson.M{}, func(entry bson.M) error {
+			if data, ok := entry["data"].(bson.M); ok && needsRotation(fields, keys, data) {
+				staleEntries = append(staleEntries, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return rotated, err
+		}
+		for _, entry := range staleEntries {
+			id, _ := entry["_id"].(primitive.ObjectID)
+			data := entry["data"].(bson.M)
+			if err := decryptFields(fields, data); err != nil {
+				return rotated, fmt.Errorf("%s %s: %w", historyCollection(collection), id.Hex(), err)
+			}
+			encrypted, err := encryptDocument(collection, data)
+			if err != nil {
+				return rotated, err
+			}
+			var updated bson.M
+			if err := db.UpdateRecord(ctx, historyCollection(collection), id, bson.M{"data": encrypted}, &updated); err != nil {
+				return rotated, fmt.Errorf("%s %s: %w", historyCollection(collection), id.Hex(), err)
+			}
+			rotated++
+		}
+	}
+	return rotated, nil
+}
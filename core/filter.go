@@ -0,0 +1,102 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lodjim/naboobase/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// filterOptions describes the schema of a collection to the filter compiler, with the fields
+// of its embedded documents and related records. The fields a client can't see are left out,
+// so they can't be probed through filters.
+func filterOptions(collection string, superuser bool) (utils.FilterOptions, error) {
+	schema, err := loadSchema(collection)
+	if err != nil {
+		return utils.FilterOptions{}, err
+	}
+	field := func(name string) (utils.FieldDefinition, bool) {
+		definition, _, ok := resolvePath(collection, superuser, name)
+		return definition, ok
+	}
+	enum := func(name string) (utils.EnumDefinition, bool) {
+		definition, ok := schema.Enums[name]
+		return definition, ok
+	}
+	return utils.FilterOptions{Field: field, Enum: enum}, nil
+}
+
+// compileFilter compiles the filter of a request to a collection to a MongoDB query.
+func compileFilter(collection string, superuser bool, filterSearch string) (bson.M, error) {
+	options, err := filterOptions(collection, superuser)
+	if err != nil {
+		return nil, err
+	}
+	return utils.TransformFilterToMongoQueryWithOptions(filterSearch, options)
+}
+
+// compileRequestFilter compiles the filter of a request, with the macros bound to the request
+// and the calendar macros in the time zone of its tz query parameter.
+func compileRequestFilter(c *gin.Context, collection string, filterSearch string) (bson.M, error) {
+	options, err := filterOptions(collection, requestIsSuperUser(c))
+	if err != nil {
+		return nil, err
+	}
+	if tz := c.Query("tz"); tz != "" {
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone %s", tz)
+		}
+		options.Location = location
+	}
+	options.Macro = requestMacro(c)
+	return utils.TransformFilterToMongoQueryWithOptions(filterSearch, options)
+}
+
+// requestMacro resolves the @request macros: the user of the request under
+// @request.auth, and its query parameters and headers under @request.query and
+// @request.headers, where underscores stand for the dashes of the header names.
+func requestMacro(c *gin.Context) func(name string) (interface{}, bool, error) {
+	return func(name string) (interface{}, bool, error) {
+		switch {
+		case strings.HasPrefix(name, "request.auth."):
+			actor := actorFromRequest(c)
+			values := map[string]string{"id": actor.Id, "email": actor.Email, "role": actor.Role}
+			value, ok := values[strings.TrimPrefix(name, "request.auth.")]
+			if !ok {
+				return nil, false, nil
+			}
+			if actor.Id == "" {
+				return nil, false, utils.ErrNoMatch
+			}
+			return value, true, nil
+		case strings.HasPrefix(name, "request.query."):
+			if value, ok := c.GetQuery(strings.TrimPrefix(name, "request.query.")); ok {
+				return value, true, nil
+			}
+			return nil, true, nil
+		case strings.HasPrefix(name, "request.headers."):
+			header := strings.ReplaceAll(strings.TrimPrefix(name, "request.headers."), "_", "-")
+			if values := c.Request.Header.Values(header); len(values) > 0 {
+				return values[0], true, nil
+			}
+			return nil, true, nil
+		}
+		return nil, false, nil
+	}
+}
+
+// checkSortField rejects sorting on the fields that can't be filtered on.
+func checkSortField(collection string, superuser bool, name string) error {
+	_, relations, ok := resolvePath(collection, superuser, name)
+	if !ok {
+		return fmt.Errorf("Unknown sort field %s", name)
+	}
+	if len(relations) > 0 {
+		return fmt.Errorf("The field %s of a related record can't be used to sort", name)
+	}
+	return nil
+}
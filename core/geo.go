@@ -0,0 +1,30 @@
+package core
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// distanceField is the name under which list endpoints return the distance, in meters,
+// between a record and the point of the near() condition of the filter.
+const distanceField = "_distance"
+
+// ensureGeoIndexes creates a 2dsphere index on every geo_point field of a collection.
+func ensureGeoIndexes(ctx context.Context, db MongoDBconnector, collection string) error {
+	schema, err := loadSchema(collection)
+	if err != nil {
+		return err
+	}
+	for _, field := range schema.Root.Fields {
+		if field.SchemaType != "geo_point" {
+			continue
+		}
+		index := mongo.IndexModel{Keys: bson.D{{Key: field.BSONTag, Value: "2dsphere"}}}
+		if err := db.EnsureIndexes(ctx, collection, index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/copier"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type HistoryEntry struct {
+	Id        primitive.ObjectID `json:"_id" bson:"_id" db:"autogenerate"`
+	RecordId  primitive.ObjectID `json:"record_id" bson:"record_id"`
+	Version   int64              `json:"version" bson:"version"`
+	Operation string             `json:"operation" bson:"operation"`
+	ActorId   string             `json:"actor_id" bson:"actor_id"`
+	Data      bson.M             `json:"data" bson:"data"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+func historyCollection(collection string) string {
+	return collection + "_history"
+}
+
+// historyCounterCollection holds the last version of the snapshots of every record of a
+// collection, under the ID of the record.
+func historyCounterCollection(collection string) string {
+	return collection + "_history_versions"
+}
+
+// writeHistory snapshots the previous version of a record updated or deleted in a collection
+// whose _config enables the history.
+func writeHistory(ctx context.Context, db MongoDBconnector, change RecordChange) error {
+	if change.Before == nil {
+		return nil
+	}
+	var modelConfig ModelConfig
+	if err := loadConfig(change.Collection, &modelConfig); err != nil || !modelConfig.ContentConfigs.History {
+		return nil
+	}
+	id, err := primitive.ObjectIDFromHex(change.RecordId)
+	if err != nil {
+		return nil
+	}
+	// Snapshots keep the encrypted fields of the collection sealed
+	data, err := encryptDocument(change.Collection, change.Before)
+	var version int64
+	if err == nil {
+		version, err = nextHistoryVersion(ctx, db, change.Collection, id)
+	}
+	if err == nil {
+		err = db.CreateRecord(ctx, historyCollection(change.Collection), &HistoryEntry{
+			RecordId:  id,
+			Version:   version,
+			Operation: change.Operation,
+			ActorId:   change.Actor.Id,
+			Data:      data,
+			CreatedAt: time.Now().UTC(),
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("saving the history: %w", err)
+	}
+	return nil
+}
+
+// nextHistoryVersion allocates the next version of the snapshots of a record with an atomic
+// counter, so that concurrent writes, in a transaction or not, never share a version. The
+// counter of a record saved before the counters existed starts after its snapshots.
+func nextHistoryVersion(ctx context.Context, db MongoDBconnector, collection string, id primitive.ObjectID) (int64, error) {
+	counters := historyCounterCollection(collection)
+	version, ok, err := db.IncrementCounter(ctx, counters, id)
+	if err != nil || ok {
+		return version, err
+	}
+	versions, err := db.CountRecords(ctx, historyCollection(collection), bson.M{"record_id": id})
+	if err != nil {
+		return 0, err
+	}
+	if err := db.CreateCounter(ctx, counters, id, versions); err != nil {
+		return 0, err
+	}
+	version, _, err = db.IncrementCounter(ctx, counters, id)
+	return version, err
+}
+
+// ensureHistoryIndexes makes versions unique per record, a safety net under the counters
+// allocating them.
+func ensureHistoryIndexes(ctx context.Context, db MongoDBconnector, collection string, modelConfig ModelConfig) error {
+	if !modelConfig.ContentConfigs.History {
+		return nil
+	}
+	return db.EnsureIndexes(ctx, historyCollection(collection), mongo.IndexModel{
+		Keys:    bson.D{{Key: "record_id", Value: 1}, {Key: "version", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+}
+
+// historyVersion reads the :id and :version parameters and fetches the matching snapshot.
+// The response is written when it can't be found.
+func historyVersion(c *gin.Context, ctx context.Context, db MongoDBconnector, config HandlerConfig) (primitive.ObjectID, *HistoryEntry, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return id, nil, false
+	}
+	version, err := strconv.ParseInt(c.Param("version"), 10, 64)
+	if err != nil || version < 1 {
+		c.String(http.StatusBadRequest, "The version should be a positive integer")
+		return id, nil, false
+	}
+	var entry HistoryEntry
+	err = db.GetRecord(ctx, historyCollection(config.Collection), bson.M{"record_id": id, "version": version}, &entry)
+	if err == mongo.ErrNoDocuments {
+		c.String(http.StatusNotFound, fmt.Sprintf("The version %d of %s doesn't exist", version, id.Hex()))
+		return id, nil, false
+	}
+	if err == nil {
+		err = decryptDocument(config.Collection, entry.Data)
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return id, nil, false
+	}
+	return id, &entry, true
+}
+
+// historyResponse opens a snapshot and hides the fields the response of the collection
+// doesn't expose.
+func historyResponse(config HandlerConfig, superuser bool, entry map[string]interface{}) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	switch snapshot := entry["data"].(type) {
+	case bson.M:
+		data = snapshot
+	case map[string]interface{}:
+		data = snapshot
+	default:
+		return entry, nil
+	}
+	if err := decryptDocument(config.Collection, data); err != nil {
+		return nil, err
+	}
+	visible, err := visibleDocument(config.Collection, superuser, keepResponseFields(config.NewResponse(), data))
+	if err != nil {
+		return nil, err
+	}
+	entry["data"] = visible
+	return entry, nil
+}
+
+func GenerateHistoryHandler(db MongoDBconnector, config HandlerConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var modelConfig ModelConfig
+		if err := loadConfig(config.Collection, &modelConfig); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		if _, ok := authorizeRequest(c, modelConfig.ContentConfigs.GetOne.AuthRules); !ok {
+			return
+		}
+		id, err := primitive.ObjectIDFromHex(c.Param("id"))
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+		defer cancel()
+
+		page, _ := strconv.ParseInt(c.Query("page"), 10, 64)
+		if page < 1 {
+			page = 1
+		}
+		limit, _ := strconv.ParseInt(c.Query("limit"), 10, 64)
+		if limit < 1 {
+			limit = 50
+		}
+		if limit > 1000 {
+			limit = 1000
+		}
+
+		var results []map[string]interface{}
+		sort := bson.D{{Key: "version", Value: -1}}
+		total, err := db.GetPaginatedRecords(ctx, historyCollection(config.Collection), bson.M{"record_id": id}, page, limit, sort, nil, &results)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		for i := range results {
+			if results[i], err = historyResponse(config, requestIsSuperUser(c), results[i]); err != nil {
+				c.String(http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"total": total,
+			"data":  results,
+		})
+	}
+}
+
+func GenerateHistoryVersionHandler(db MongoDBconnector, config HandlerConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var modelConfig ModelConfig
+		if err := loadConfig(config.Collection, &modelConfig); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		if _, ok := authorizeRequest(c, modelConfig.ContentConfigs.GetOne.AuthRules); !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+		defer cancel()
+		_, entry, ok := historyVersion(c, ctx, db, config)
+		if !ok {
+			return
+		}
+		document, err := toDocument(entry)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		response, err := historyResponse(config, requestIsSuperUser(c), document)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// GenerateRevertHandler restores a record to one of its snapshots. The snapshot is sent
+// through the same validation as an update, and the version it replaces is saved in turn.
+// The current values of the read-only and hidden fields are left as they are.
+func GenerateRevertHandler(db MongoDBconnector, config HandlerConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var modelConfig ModelConfig
+		if err := loadConfig(config.Collection, &modelConfig); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		if _, ok := authorizeRequest(c, modelConfig.ContentConfigs.Update.AuthRules); !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+		defer cancel()
+		id, entry, ok := historyVersion(c, ctx, db, config)
+		if !ok {
+			return
+		}
+
+		// Go through the model so that the payload looks like the one a client would send
+		snapshot := config.NewModel()
+		encoded, err := bson.Marshal(entry.Data)
+		if err == nil {
+			err = bson.Unmarshal(encoded, snapshot)
+		}
+		var payload map[string]interface{}
+		if err == nil {
+			encoded, err = json.Marshal(snapshot)
+		}
+		if err == nil {
+			err = json.Unmarshal(encoded, &payload)
+		}
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		delete(payload, "_id")
+		schema, err := loadSchema(config.Collection)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		// Computed fields are recomputed by the update, and read-only and hidden ones are kept.
+		// Hidden fields are managed by the server, a revert doesn't bring back an old password
+		// hash for instance.
+		for _, field := range schema.Root.Fields {
+			if field.SchemaType == "computed" || field.ReadOnly || field.Hidden {
+				delete(payload, field.JSONTag)
+			}
+		}
+		rawData, err := json.Marshal(payload)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		data, status, err := prepareUpdate(config, rawData)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		model := config.NewModel()
+		if config.Preprocess != nil {
+			if err := config.Preprocess(model, id, nil); err != nil {
+				c.String(http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		if err := updateRecord(ctx, db, config.Collection, actorFromRequest(c), id, data, model); err != nil {
+			c.String(http.StatusBadRequest, "Failed to revert the record: "+err.Error())
+			return
+		}
+		res := config.NewResponse()
+		if err := copier.Copy(res, model); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		rendered, err := renderVisible(config.Collection, requestIsSuperUser(c), res)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, rendered)
+	}
+}
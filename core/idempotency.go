@@ -0,0 +1,203 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lodjim/naboobase/configs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	idempotencyCollection     = "_idempotency"
+	idempotencyExpiryIndex    = "idempotency_expiry"
+	maxIdempotencyKeyLength   = 255
+)
+
+// A request still running after this long is considered lost, and its key can be used again
+const idempotencyPendingTimeout = time.Minute
+
+// IdempotencyEntry keeps the response of a request sent with an Idempotency-Key. Status is 0
+// while the first request is running.
+type IdempotencyEntry struct {
+	Id          primitive.ObjectID `json:"_id" bson:"_id" db:"autogenerate"`
+	Key         string             `json:"key" bson:"key"`
+	Fingerprint string             `json:"fingerprint" bson:"fingerprint"`
+	Status      int                `json:"status" bson:"status"`
+	ContentType string             `json:"content_type" bson:"content_type"`
+	Body        []byte             `json:"body" bson:"body"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// responseRecorder keeps a copy of the body written by a handler.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (recorder *responseRecorder) Write(data []byte) (int, error) {
+	recorder.body.Write(data)
+	return recorder.ResponseWriter.Write(data)
+}
+
+func (recorder *responseRecorder) WriteString(data string) (int, error) {
+	recorder.body.WriteString(data)
+	return recorder.ResponseWriter.WriteString(data)
+}
+
+func hashHex(parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// claimIdempotencyKey stores a pending entry for a key, or returns the entry already stored
+// for it. Expired entries and the ones of lost requests are replaced.
+func claimIdempotencyKey(ctx context.Context, db MongoDBconnector, key string, fingerprint string) (*IdempotencyEntry, bool, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		entry := &IdempotencyEntry{Key: key, Fingerprint: fingerprint, CreatedAt: time.Now().UTC()}
+		err := db.CreateRecord(ctx, idempotencyCollection, entry)
+		if err == nil {
+			return entry, true, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, false, err
+		}
+		var stored IdempotencyEntry
+		err = db.GetRecord(ctx, idempotencyCollection, bson.M{"key": key}, &stored)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		age := time.Since(stored.CreatedAt)
+		if age < configs.GetIdempotencyWindow() && (stored.Status != 0 || age < idempotencyPendingTimeout) {
+			return &stored, false, nil
+		}
+		// The TTL index removes expired entries with a delay, don't wait for it
+		if _, err := db.DeleteManyRecords(ctx, idempotencyCollection, bson.M{"_id": stored.Id, "created_at": stored.CreatedAt}); err != nil {
+			return nil, false, err
+		}
+	}
+	return nil, false, fmt.Errorf("failed to claim the idempotency key")
+}
+
+// Idempotent makes a handler honour the Idempotency-Key header. The successful response of the
+// first request sent with a key is stored for IDEMPOTENCY_WINDOW and replayed to the retries,
+// while reusing a key for a different request is rejected with a 422. Keys are scoped by user.
+func Idempotent(db MongoDBconnector, handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" {
+			handler(c)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.String(http.StatusBadRequest, fmt.Sprintf("The %s header can't be longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength))
+			return
+		}
+		body, err := c.GetRawData()
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		scopedKey := hashHex(actorFromRequest(c).Id, key)
+		fingerprint := hashHex(c.Request.Method, c.Request.URL.Path, c.Request.URL.RawQuery, string(body))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		entry, claimed, err := claimIdempotencyKey(ctx, db, scopedKey, fingerprint)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !claimed {
+			if entry.Fingerprint != fingerprint {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("The %s was already used for a different request", idempotencyKeyHeader)})
+				return
+			}
+			if entry.Status == 0 {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("A request with the same %s is still running", idempotencyKeyHeader)})
+				return
+			}
+			c.Header(idempotencyReplayedHeader, "true")
+			c.Data(entry.Status, entry.ContentType, entry.Body)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		handler(c)
+
+		storeCtx, cancelStore := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelStore()
+		status := recorder.Status()
+		if status < 200 || status >= 300 {
+			// Failed requests can be fixed and retried with the same key
+			if _, err := db.DeleteManyRecords(storeCtx, idempotencyCollection, bson.M{"_id": entry.Id}); err != nil {
+				fmt.Printf("Error releasing the idempotency key %s: %s\n", key, err.Error())
+			}
+			return
+		}
+		update := bson.M{
+			"status":       status,
+			"content_type": recorder.Header().Get("Content-Type"),
+			"body":         recorder.body.Bytes(),
+		}
+		if err := db.UpdateRecord(storeCtx, idempotencyCollection, entry.Id, update, &IdempotencyEntry{}); err != nil {
+			fmt.Printf("Error storing the response of the idempotency key %s: %s\n", key, err.Error())
+		}
+	}
+}
+
+// idempotentEndpoints makes the POST endpoints honour the Idempotency-Key header.
+func idempotentEndpoints(db MongoDBconnector, endpoints []Endpoint) []Endpoint {
+	for i := range endpoints {
+		if endpoints[i].Method == "POST" {
+			endpoints[i].Handler = Idempotent(db, endpoints[i].Handler)
+		}
+	}
+	return endpoints
+}
+
+// ensureIdempotencyIndexes makes keys unique and expires them after IDEMPOTENCY_WINDOW.
+func ensureIdempotencyIndexes(ctx context.Context, db MongoDBconnector) error {
+	unique := mongo.IndexModel{
+		Keys:    bson.D{{Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	if err := db.EnsureIndexes(ctx, idempotencyCollection, unique); err != nil {
+		return err
+	}
+	expiry := mongo.IndexModel{
+		Keys: bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().
+			SetName(idempotencyExpiryIndex).
+			SetExpireAfterSeconds(int32(configs.GetIdempotencyWindow().Seconds())),
+	}
+	if err := db.EnsureIndexes(ctx, idempotencyCollection, expiry); err != nil {
+		// The window changed since the index was created, rebuild it
+		if dropErr := db.DropIndex(ctx, idempotencyCollection, idempotencyExpiryIndex); dropErr != nil {
+			return err
+		}
+		return db.EnsureIndexes(ctx, idempotencyCollection, expiry)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// EnsureCollectionIndexes creates, for every auto-served collection, the indexes its
+// _config asks for. It is called once at startup by AutoServe.
+func EnsureCollectionIndexes(db MongoDBconnector) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if err := ensureAuditIndexes(ctx, db); err != nil {
+		fmt.Printf("Error creating the audit log indexes: %s\n", err.Error())
+	}
+	if err := ensureIdempotencyIndexes(ctx, db); err != nil {
+		fmt.Printf("Error creating the idempotency key indexes: %s\n", err.Error())
+	}
+	if err := ensureSlowQueryIndexes(ctx, db); err != nil {
+		fmt.Printf("Error creating the slow query log indexes: %s\n", err.Error())
+	}
+	for collection := range HandlerConfigRegistry {
+		var modelConfig ModelConfig
+		if err := loadConfig(collection, &modelConfig); err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		if err := ensureSearchIndex(ctx, db, collection, modelConfig); err != nil {
+			fmt.Printf("Error creating the search index of %s: %s\n", collection, err.Error())
+		}
+		if err := ensureHistoryIndexes(ctx, db, collection, modelConfig); err != nil {
+			fmt.Printf("Error creating the history indexes of %s: %s\n", collection, err.Error())
+		}
+		if err := ensureGeoIndexes(ctx, db, collection); err != nil {
+			fmt.Printf("Error creating the geospatial indexes of %s: %s\n", collection, err.Error())
+		}
+		if err := ensureTTLIndex(ctx, db, collection, modelConfig); err != nil {
+			fmt.Printf("Error creating the TTL index of %s: %s\n", collection, err.Error())
+		}
+		if err := ensureEncryptionIndexes(ctx, db, collection); err != nil {
+			fmt.Printf("Error creating the encrypted field indexes of %s: %s\n", collection, err.Error())
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lodjim/naboobase/configs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const slowQueryCollection = "_slow_queries"
+
+const slowQueryRetentionIndexName = "slow_query_retention"
+
+// Slow queries are kept for a week
+const slowQueryRetention = 7 * 24 * time.Hour
+
+// SlowQuery is a query of a list or aggregate endpoint that took longer than
+// SLOW_QUERY_THRESHOLD. Query is the extended JSON of what the database ran, with the
+// encrypted values as stored.
+type SlowQuery struct {
+	Id         primitive.ObjectID `json:"_id" bson:"_id" db:"autogenerate"`
+	Collection string             `json:"collection" bson:"collection"`
+	Operation  string             `json:"operation" bson:"operation"`
+	Query      string             `json:"query" bson:"query"`
+	DurationMs int64              `json:"duration_ms" bson:"duration_ms"`
+	ActorId    string             `json:"actor_id" bson:"actor_id"`
+	IP         string             `json:"ip" bson:"ip"`
+	RequestId  string             `json:"request_id" bson:"request_id"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// extendedJSON renders a query the way the database sees it, ObjectIDs and dates included.
+func extendedJSON(query interface{}) (json.RawMessage, error) {
+	encoded, err := bson.MarshalExtJSON(bson.M{"v": query}, false, false)
+	if err != nil {
+		return nil, err
+	}
+	var wrapped struct {
+		V json.RawMessage `json:"v"`
+	}
+	if err := json.Unmarshal(encoded, &wrapped); err != nil {
+		return nil, err
+	}
+	return wrapped.V, nil
+}
+
+// logSlowQuery writes a query of a request to the slow query log when it took longer than
+// SLOW_QUERY_THRESHOLD. The query is described by a document such as {filter, sort}, whose
+// filter is encrypted as it was sent to the database.
+func logSlowQuery(c *gin.Context, db MongoDBconnector, collection string, operation string, query bson.M, started time.Time) {
+	duration := time.Since(started)
+	if duration < configs.GetSlowQueryThreshold() {
+		return
+	}
+	if filter, ok := query["filter"].(bson.M); ok {
+		encrypted, err := encryptFilter(collection, filter)
+		if err != nil {
+			return
+		}
+		query["filter"] = encrypted
+	}
+	rendered, err := extendedJSON(query)
+	if err != nil {
+		fmt.Printf("Error rendering the slow query of %s: %s\n", collection, err.Error())
+		return
+	}
+	actor := actorFromRequest(c)
+	entry := &SlowQuery{
+		Collection: collection,
+		Operation:  operation,
+		Query:      string(rendered),
+		DurationMs: duration.Milliseconds(),
+		ActorId:    actor.Id,
+		IP:         actor.IP,
+		RequestId:  actor.RequestId,
+		CreatedAt:  time.Now().UTC(),
+	}
+	// The response doesn't wait for the log
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := db.CreateRecord(ctx, slowQueryCollection, entry); err != nil {
+			fmt.Printf("Error writing the slow query of %s: %s\n", collection, err.Error())
+		}
+	}()
+}
+
+// explainList answers a list request with the query compiled from it and the way the
+// database runs it, instead of the records.
+func explainList(c *gin.Context, db MongoDBconnector, collection string, joins []bson.M, filter bson.M, page int64, limit int64, sort bson.D, projection bson.M) {
+	filter, err := encryptFilter(collection, filter)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	compiled := bson.M{"filter": filter, "sort": sort, "projection": projection}
+	command := bson.D{
+		{Key: "find", Value: collection},
+		{Key: "filter", Value: filter},
+		{Key: "sort", Value: sort},
+		{Key: "skip", Value: (page - 1) * limit},
+		{Key: "limit", Value: limit},
+	}
+	if projection != nil {
+		command = append(command, bson.E{Key: "projection", Value: projection})
+	}
+	if joins != nil {
+		pipeline := joinedPage(joinedMatch(joins, filter), page, limit, sort)
+		compiled["pipeline"] = pipeline
+		command = bson.D{
+			{Key: "aggregate", Value: collection},
+			{Key: "pipeline", Value: pipeline},
+			{Key: "cursor", Value: bson.M{}},
+		}
+	}
+	rendered, err := extendedJSON(compiled)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+	explain, err := db.Explain(ctx, command)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	explained, err := extendedJSON(explain)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"query":   rendered,
+		"explain": explained,
+	})
+}
+
+// ensureSlowQueryIndexes expires the slow query log after a week.
+func ensureSlowQueryIndexes(ctx context.Context, db MongoDBconnector) error {
+	expiry := mongo.IndexModel{
+		Keys: bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().
+			SetName(slowQueryRetentionIndexName).
+			SetExpireAfterSeconds(int32(slowQueryRetention.Seconds())),
+	}
+	return db.EnsureIndexes(ctx, slowQueryCollection, expiry)
+}
+
+type SlowQueryManagement struct {
+}
+
+func (slowQueryManagement *SlowQueryManagement) GetSlowQueries(db MongoDBconnector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := authorizeRequest(c, AuthRules{ShouldBeAuthenticated: true, OnlyForAdmin: true}); !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+		defer cancel()
+
+		filter := bson.M{}
+		if collection := c.Query("collection"); collection != "" {
+			filter["collection"] = collection
+		}
+
+		page, _ := strconv.ParseInt(c.Query("page"), 10, 64)
+		if page < 1 {
+			page = 1
+		}
+		limit, _ := strconv.ParseInt(c.Query("limit"), 10, 64)
+		if limit < 1 {
+			limit = 50
+		}
+		if limit > 1000 {
+			limit = 1000
+		}
+
+		var results []map[string]interface{}
+		sort := bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}
+		total, err := db.GetPaginatedRecords(ctx, slowQueryCollection, filter, page, limit, sort, nil, &results)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"total": total,
+			"data":  results,
+		})
+	}
+}
+
+func (slowQueryManagement *SlowQueryManagement) Init(db MongoDBconnector) []Endpoint {
+	var endpoints []Endpoint = []Endpoint{{
+		Method:  "GET",
+		Path:    "/admin/slow-queries",
+		Handler: slowQueryManagement.GetSlowQueries(db),
+	},
+	}
+	return endpoints
+}
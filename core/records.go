@@ -0,0 +1,159 @@
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lodjim/naboobase/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Actor identifies who triggered a write and from where.
+type Actor struct {
+	Id          string
+	Email       string
+	Role        string
+	IsSuperUser bool
+	IP          string
+	RequestId   string
+}
+
+// SystemActor is used for the writes naboobase does on its own, such as record expiry.
+var SystemActor = Actor{Id: "system"}
+
+func actorFromRequest(c *gin.Context) Actor {
+	actor := Actor{
+		IP:        c.ClientIP(),
+		RequestId: c.GetString(requestIdKey),
+	}
+	var claims *utils.Claims
+	if got_claims, ok := c.Get("claims"); ok {
+		claims, _ = got_claims.(*utils.Claims)
+	} else if parsed, err := utils.GetClaims(c); err == nil {
+		claims = parsed
+	}
+	if claims != nil {
+		actor.Id = claims.Id
+		actor.Email = claims.Email
+		actor.Role = claims.Role
+		actor.IsSuperUser = claims.IsSuperUser
+	}
+	return actor
+}
+
+// RecordChange describes a write on a single record. Before is nil for a create and After
+// is nil for a delete.
+type RecordChange struct {
+	Collection string
+	RecordId   string
+	Operation  string // "create", "update" or "delete"
+	Before     bson.M
+	After      bson.M
+	Actor      Actor
+}
+
+// toDocument converts a model to the document stored in the database.
+func toDocument(record interface{}) (bson.M, error) {
+	if document, ok := record.(bson.M); ok {
+		return document, nil
+	}
+	encoded, err := bson.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var document bson.M
+	return document, bson.Unmarshal(encoded, &document)
+}
+
+// recordChange runs what has to follow every write on a record, whichever endpoint did it.
+// In a transaction a change that can't be recorded fails it, so that the write is rolled back
+// rather than left without a trace. Otherwise the write is done and the failure is logged.
+func recordChange(ctx context.Context, db MongoDBconnector, change RecordChange) error {
+	invalidateCache(change.Collection, change.RecordId)
+	for _, err := range []error{writeAudit(ctx, db, change), writeHistory(ctx, db, change)} {
+		if err == nil {
+			continue
+		}
+		if mongo.SessionFromContext(ctx) != nil {
+			return err
+		}
+		fmt.Printf("Error recording the %s of %s %s: %s\n", change.Operation, change.Collection, change.RecordId, err.Error())
+	}
+	return nil
+}
+
+// createRecord inserts a prepared model and records the change.
+func createRecord(ctx context.Context, db MongoDBconnector, collection string, actor Actor, model interface{}) error {
+	if err := db.CreateRecord(ctx, collection, model); err != nil {
+		return err
+	}
+	after, err := toDocument(model)
+	if err != nil {
+		return err
+	}
+	return recordChange(ctx, db, RecordChange{Collection: collection, RecordId: recordId(model), Operation: "create", After: after, Actor: actor})
+}
+
+// updateRecord applies validated update data to a record, decodes the updated record into
+// model and records the change.
+func updateRecord(ctx context.Context, db MongoDBconnector, collection string, actor Actor, id primitive.ObjectID, data map[string]interface{}, model interface{}) error {
+	var before bson.M
+	if err := db.GetRecord(ctx, collection, bson.M{"_id": id}, &before); err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if before != nil {
+		if err := computeStoredUpdate(collection, before, data); err != nil {
+			return err
+		}
+	}
+	if err := db.UpdateRecord(ctx, collection, id, data, model); err != nil {
+		return err
+	}
+	after, err := toDocument(model)
+	if err != nil {
+		return err
+	}
+	return recordChange(ctx, db, RecordChange{Collection: collection, RecordId: id.Hex(), Operation: "update", Before: before, After: after, Actor: actor})
+}
+
+// deleteRecord deletes a record and records the change.
+func deleteRecord(ctx context.Context, db MongoDBconnector, collection string, actor Actor, id primitive.ObjectID, model interface{}) error {
+	var before bson.M
+	if err := db.GetRecord(ctx, collection, bson.M{"_id": id}, &before); err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if err := db.DeleteRecordById(ctx, collection, id, model); err != nil {
+		return err
+	}
+	return recordChange(ctx, db, RecordChange{Collection: collection, RecordId: id.Hex(), Operation: "delete", Before: before, Actor: actor})
+}
+
+// idFilter matches the records of a list of IDs, none when the list is empty.
+func idFilter(ids []primitive.ObjectID) bson.M {
+	if ids == nil {
+		// A nil list is sent as null, which $in rejects
+		ids = []primitive.ObjectID{}
+	}
+	return bson.M{"_id": bson.M{"$in": ids}}
+}
+
+// matchingRecords returns the records matching a filter, indexed by ID, along with the IDs
+// in the order they were found. At most limit records are read, all of them when it is 0.
+func matchingRecords(ctx context.Context, db MongoDBconnector, collection string, filter bson.M, limit int64) (map[primitive.ObjectID]bson.M, []primitive.ObjectID, error) {
+	records := make(map[primitive.ObjectID]bson.M)
+	ids := []primitive.ObjectID{}
+	err := db.IterateRecords(ctx, collection, filter, func(record bson.M) error {
+		id, ok := record["_id"].(primitive.ObjectID)
+		if !ok {
+			return fmt.Errorf("the record %v has no ObjectID", record["_id"])
+		}
+		records[id] = record
+		ids = append(ids, id)
+		return nil
+	}, options.Find().SetLimit(limit))
+	return records, ids, err
+}
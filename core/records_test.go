@@ -0,0 +1,38 @@
+package core
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIdFilterWithoutIds(t *testing.T) {
+	for _, ids := range [][]primitive.ObjectID{nil, {}} {
+		encoded, err := bson.Marshal(idFilter(ids))
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := bson.Raw(encoded).Lookup("_id", "$in")
+		if in.Type != bsontype.Array {
+			t.Fatalf("$in is sent as %s, want an array", in.Type)
+		}
+		values, err := in.Array().Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 0 {
+			t.Fatalf("$in holds %d values, want none", len(values))
+		}
+	}
+}
+
+func TestIdFilter(t *testing.T) {
+	id := primitive.NewObjectID()
+	filter := idFilter([]primitive.ObjectID{id})
+	ids, ok := filter["_id"].(bson.M)["$in"].([]primitive.ObjectID)
+	if !ok || len(ids) != 1 || ids[0] != id {
+		t.Fatalf("unexpected filter %v", filter)
+	}
+}
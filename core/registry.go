@@ -5,3 +5,7 @@ import (
 )
 
 var AutoEndpointFuncRegistry = make(map[string]func(MongoDBconnector) gin.HandlerFunc)
+
+// HandlerConfigRegistry keeps the handler configuration of every auto-served collection,
+// so that generic endpoints (batch, bulk, ...) can reach a collection by its name.
+var HandlerConfigRegistry = make(map[string]HandlerConfig)
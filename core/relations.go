@@ -0,0 +1,220 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lodjim/naboobase/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Number of foreign keys a filter path can cross, user_id.org_id.name crosses two
+const maxJoinDepth = 2
+
+// The related records are looked up under this field, which is never returned
+const joinedField = "_joined"
+
+// relation is a foreign key crossed by a filter path. Path is the foreign key as seen from
+// the filtered collection, such as user_id or user_id.org_id.
+type relation struct {
+	Path  string
+	Model string
+}
+
+func foreignKeyModel(modelConfig ModelConfig, name string) (string, bool) {
+	for _, foreignKey := range modelConfig.ContentConfigs.ForeignKeys {
+		if foreignKey.Name == name {
+			return foreignKey.Model, true
+		}
+	}
+	return "", false
+}
+
+// resolvePath follows a field path of a collection through its embedded documents and its
+// foreign keys. It returns the field at the end of the path and the relations crossed to
+// reach it, ok is false when the path leads to a field a client can't see.
+func resolvePath(collection string, superuser bool, name string) (utils.FieldDefinition, []relation, bool) {
+	var relations []relation
+	prefix := ""
+	parts := strings.Split(name, ".")
+	for {
+		schema, err := loadSchema(collection)
+		if err != nil {
+			return utils.FieldDefinition{}, nil, false
+		}
+		var modelConfig ModelConfig
+		if err := loadConfig(collection, &modelConfig); err != nil {
+			return utils.FieldDefinition{}, nil, false
+		}
+		if model, ok := foreignKeyModel(modelConfig, parts[0]); ok && len(parts) > 1 {
+			if field, ok := schema.Field(parts[0]); !ok || !isVisible(field, superuser) {
+				return utils.FieldDefinition{}, nil, false
+			}
+			prefix = strings.TrimPrefix(prefix+"."+parts[0], ".")
+			relations = append(relations, relation{Path: prefix, Model: model})
+			collection, parts = model, parts[1:]
+			continue
+		}
+		var field utils.FieldDefinition
+		for i := range parts {
+			var ok bool
+			field, ok = schema.Field(strings.Join(parts[:i+1], "."))
+			if !ok || !isVisible(field, superuser) {
+				return utils.FieldDefinition{}, nil, false
+			}
+		}
+		if len(relations) > 0 {
+			// The related records are matched as stored
+			if field.Encryption != "" || (field.SchemaType == "computed" && !field.Stored) {
+				return utils.FieldDefinition{}, nil, false
+			}
+		}
+		return field, relations, true
+	}
+}
+
+// filterRelations lists the relations a filter of a collection crosses, parents first.
+func filterRelations(collection string, superuser bool, filter bson.M) ([]relation, error) {
+	crossed := make(map[string]relation)
+	for _, name := range queryFields(filter) {
+		_, relations, ok := resolvePath(collection, superuser, name)
+		if !ok {
+			continue
+		}
+		if len(relations) > maxJoinDepth {
+			return nil, fmt.Errorf("%s crosses more than %d relations", name, maxJoinDepth)
+		}
+		for _, relation := range relations {
+			crossed[relation.Path] = relation
+		}
+	}
+	relations := make([]relation, 0, len(crossed))
+	for _, relation := range crossed {
+		relations = append(relations, relation)
+	}
+	sort.Slice(relations, func(i, j int) bool {
+		return strings.Count(relations[i].Path, ".") < strings.Count(relations[j].Path, ".") ||
+			(strings.Count(relations[i].Path, ".") == strings.Count(relations[j].Path, ".") && relations[i].Path < relations[j].Path)
+	})
+	return relations, nil
+}
+
+// lookupStages looks each related record up under joinedField, at the path of its foreign
+// key. Foreign keys hold the hexadecimal ID of the related record.
+func lookupStages(relations []relation) []bson.M {
+	var stages []bson.M
+	for _, relation := range relations {
+		local := "$" + relation.Path
+		if strings.Contains(relation.Path, ".") {
+			// The foreign key belongs to a record looked up before
+			local = "$" + joinedField + "." + relation.Path
+		}
+		as := joinedField + "." + relation.Path
+		stages = append(stages,
+			bson.M{"$lookup": bson.M{
+				"from": relation.Model,
+				"let":  bson.M{"id": local},
+				"pipeline": bson.A{
+					bson.M{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{
+						"$_id",
+						bson.M{"$convert": bson.M{"input": "$$id", "to": "objectId", "onError": nil, "onNull": nil}},
+					}}}},
+					bson.M{"$limit": 1},
+				},
+				"as": as,
+			}},
+			bson.M{"$unwind": bson.M{"path": "$" + as, "preserveNullAndEmptyArrays": true}},
+		)
+	}
+	return stages
+}
+
+// joinedMatch returns the stages matching the records of a filter on their related records.
+func joinedMatch(joins []bson.M, filter bson.M) []bson.M {
+	return append(append([]bson.M{}, joins...), bson.M{"$match": filter})
+}
+
+// joinedPage returns the stages reading a page of the records matched, without their related
+// records.
+func joinedPage(match []bson.M, page int64, limit int64, sort bson.D) []bson.M {
+	return append(append([]bson.M{}, match...),
+		bson.M{"$sort": sort},
+		bson.M{"$skip": (page - 1) * limit},
+		bson.M{"$limit": limit},
+		bson.M{"$project": bson.M{joinedField: 0}},
+	)
+}
+
+// joinedFilter points the fields of the related records in a filter to where they are
+// looked up.
+func joinedFilter(filter bson.M, relations []relation) bson.M {
+	joined := make(bson.M, len(filter))
+	for key, value := range filter {
+		if strings.HasPrefix(key, "$") {
+			switch conditions := value.(type) {
+			case []bson.M:
+				clauses := make([]bson.M, len(conditions))
+				for i, condition := range conditions {
+					clauses[i] = joinedFilter(condition, relations)
+				}
+				value = clauses
+			case bson.A:
+				clauses := make(bson.A, len(conditions))
+				for i, condition := range conditions {
+					if nested, ok := condition.(bson.M); ok {
+						condition = joinedFilter(nested, relations)
+					}
+					clauses[i] = condition
+				}
+				value = clauses
+			}
+			joined[key] = value
+			continue
+		}
+		for _, relation := range relations {
+			if strings.HasPrefix(key, relation.Path+".") {
+				key = joinedField + "." + key
+				break
+			}
+		}
+		joined[key] = value
+	}
+	return joined
+}
+
+// filterJoins returns the stages looking up the related records a filter of a collection
+// refers to, along with the filter matching them. The stages are nil when the filter doesn't
+// cross a relation. Clients can only filter on the collections they can list.
+func filterJoins(c *gin.Context, collection string, filter bson.M) ([]bson.M, bson.M, error) {
+	actor := actorFromRequest(c)
+	relations, err := filterRelations(collection, actor.IsSuperUser, filter)
+	if err != nil || len(relations) == 0 {
+		return nil, filter, err
+	}
+	claims := &utils.Claims{Id: actor.Id, IsSuperUser: actor.IsSuperUser}
+	for _, relation := range relations {
+		var modelConfig ModelConfig
+		if err := loadConfig(relation.Model, &modelConfig); err != nil {
+			return nil, nil, err
+		}
+		if _, err := checkAuthRules(modelConfig.ContentConfigs.GetAll.AuthRules, claims); err != nil {
+			return nil, nil, fmt.Errorf("The records of %s can't be filtered on", relation.Model)
+		}
+	}
+	return lookupStages(relations), joinedFilter(filter, relations), nil
+}
+
+// rejectRelations rejects the filters crossing relations, for the operations that can't
+// look related records up.
+func rejectRelations(collection string, filter bson.M) error {
+	relations, err := filterRelations(collection, true, filter)
+	if err != nil {
+		return err
+	}
+	if len(relations) > 0 {
+		return fmt.Errorf("The fields of %s records can't be used here", relations[0].Model)
+	}
+	return nil
+}
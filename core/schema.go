@@ -0,0 +1,107 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/lodjim/naboobase/utils"
+)
+
+// CollectionSchema is the parsed field definition of a collection json file.
+type CollectionSchema struct {
+	Root    *utils.StructDefinition
+	Structs map[string]*utils.StructDefinition
+	Enums   map[string]utils.EnumDefinition
+}
+
+var (
+	schemasMu sync.RWMutex
+	schemas   = make(map[string]*CollectionSchema)
+)
+
+// loadSchema returns the schema of a collection, read from its json file the first time it
+// is needed and kept for the life of the process.
+func loadSchema(collectionName string) (*CollectionSchema, error) {
+	schemasMu.RLock()
+	schema, ok := schemas[collectionName]
+	schemasMu.RUnlock()
+	if ok {
+		return schema, nil
+	}
+	schema, err := readSchema(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	schemasMu.Lock()
+	schemas[collectionName] = schema
+	schemasMu.Unlock()
+	return schema, nil
+}
+
+// loadSchemas reads the schemas of every auto-served collection, so that a missing or invalid
+// one stops the server at startup rather than failing, or leaking, its requests.
+func loadSchemas() error {
+	for collection := range HandlerConfigRegistry {
+		if _, err := loadSchema(collection); err != nil {
+			return fmt.Errorf("the schema of %s: %w", collection, err)
+		}
+	}
+	return nil
+}
+
+func readSchema(collectionName string) (*CollectionSchema, error) {
+	jsonData, err := ioutil.ReadFile(fmt.Sprintf("./json/%s.json", collectionName))
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema: %w", err)
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, fmt.Errorf("error unmarshaling schema: %w", err)
+	}
+	schema := &CollectionSchema{
+		Structs: make(map[string]*utils.StructDefinition),
+		Enums:   make(map[string]utils.EnumDefinition),
+	}
+	schema.Root = utils.ParseStruct(utils.ConvertToCamelCase(collectionName), data, schema.Structs, schema.Enums)
+	for _, field := range schema.Root.Fields {
+		// Randomized ciphertexts can't be compared, so nothing could enforce it
+		if field.Unique && field.Encryption != "deterministic" {
+			return nil, fmt.Errorf("%s can't be unique, only deterministic encrypted fields can", field.JSONTag)
+		}
+	}
+	return schema, nil
+}
+
+// Field looks a field up by its json name, following dots into embedded structs.
+func (schema *CollectionSchema) Field(name string) (utils.FieldDefinition, bool) {
+	current := schema.Root
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		var found *utils.FieldDefinition
+		for j := range current.Fields {
+			if current.Fields[j].JSONTag == part {
+				found = &current.Fields[j]
+				break
+			}
+		}
+		if found == nil {
+			return utils.FieldDefinition{}, false
+		}
+		if i == len(parts)-1 {
+			return *found, true
+		}
+		nested, ok := schema.Structs[found.Type]
+		if !ok {
+			return utils.FieldDefinition{}, false
+		}
+		current = nested
+	}
+	return utils.FieldDefinition{}, false
+}
+
+func isNumericType(fieldType string) bool {
+	return fieldType == "int" || fieldType == "float64"
+}
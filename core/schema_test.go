@@ -0,0 +1,69 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// inSchemaDir runs the test from a directory holding the given json schemas.
+func inSchemaDir(t *testing.T, files map[string]string) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "json"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, "json", name+".json"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(previous)
+		schemasMu.Lock()
+		schemas = make(map[string]*CollectionSchema)
+		schemasMu.Unlock()
+	})
+}
+
+func TestRandomizedFieldCantBeUnique(t *testing.T) {
+	inSchemaDir(t, map[string]string{
+		"randomized":    `{"cni": {"value": "Text", "db": "encrypted", "unique": true}}`,
+		"deterministic": `{"cni": {"value": "Text", "db": "encrypted", "encryption": "deterministic", "unique": true}}`,
+	})
+	if _, err := loadSchema("randomized"); err == nil {
+		t.Error("a unique randomized field should be rejected")
+	}
+	schema, err := loadSchema("deterministic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if field, _ := schema.Field("cni"); !field.Unique {
+		t.Error("the deterministic field should be unique")
+	}
+}
+
+func TestEncryptedFieldsFailClosed(t *testing.T) {
+	inSchemaDir(t, nil)
+	HandlerConfigRegistry["unreadable"] = HandlerConfig{Collection: "unreadable"}
+	defer delete(HandlerConfigRegistry, "unreadable")
+
+	if _, err := encryptedFields("unreadable"); err == nil {
+		t.Error("encryptedFields should fail without the schema")
+	}
+	if _, err := sealedRecord("unreadable", map[string]interface{}{"cni": "1"}); err == nil {
+		t.Error("a record should not be written without the schema")
+	}
+	if err := decryptResults("unreadable", []map[string]interface{}{{"cni": "1"}}); err == nil {
+		t.Error("records should not be read without the schema")
+	}
+	if err := loadSchemas(); err == nil {
+		t.Error("loadSchemas should fail on a missing schema")
+	}
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// searchScoreField is the name under which the text-search relevance is returned and sorted.
+const searchScoreField = "_score"
+
+const searchIndexName = "naboobase_search"
+
+// searchLanguage returns the text index language. "none" disables stemming and stop words,
+// which suits mixed French and Wolof content; matching stays case and accent insensitive.
+func searchLanguage(modelConfig ModelConfig) string {
+	if modelConfig.ContentConfigs.SearchLanguage != "" {
+		return modelConfig.ContentConfigs.SearchLanguage
+	}
+	return "none"
+}
+
+// searchFilter builds the $text clause used by the list endpoints for the q parameter.
+func searchFilter(modelConfig ModelConfig, search string) (bson.M, error) {
+	if len(modelConfig.ContentConfigs.Search) == 0 {
+		return nil, errors.New("search is not enabled for this collection")
+	}
+	return bson.M{
+		"$search":             search,
+		"$language":           searchLanguage(modelConfig),
+		"$caseSensitive":      false,
+		"$diacriticSensitive": false,
+	}, nil
+}
+
+// ensureSearchIndex creates the text index over the searchable fields of a collection.
+func ensureSearchIndex(ctx context.Context, db MongoDBconnector, collection string, modelConfig ModelConfig) error {
+	fields := modelConfig.ContentConfigs.Search
+	if len(fields) == 0 {
+		return nil
+	}
+	schema, err := loadSchema(collection)
+	if err != nil {
+		return err
+	}
+	keys := bson.D{}
+	for _, field := range fields {
+		definition, ok := schema.Field(field)
+		if !ok {
+			return fmt.Errorf("search field %s is not defined in %s", field, collection)
+		}
+		if definition.Type != "string" && definition.Type != "[]string" {
+			return fmt.Errorf("search field %s of %s should be a string, got %s", field, collection, definition.Type)
+		}
+		keys = append(keys, bson.E{Key: field, Value: "text"})
+	}
+	index := mongo.IndexModel{
+		Keys: keys,
+		Options: options.Index().
+			SetName(searchIndexName).
+			SetDefaultLanguage(searchLanguage(modelConfig)).
+			SetTextVersion(3),
+	}
+	if err := db.EnsureIndexes(ctx, collection, index); err != nil {
+		// The searchable fields changed since the index was created, rebuild it
+		if dropErr := db.DropIndex(ctx, collection, searchIndexName); dropErr != nil {
+			return err
+		}
+		return db.EnsureIndexes(ctx, collection, index)
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lodjim/naboobase/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultSeedBatchSize = 500
+
+// maxSeedReferences caps the number of records read to fill a foreign key.
+const maxSeedReferences = 10000
+
+type SeedOptions struct {
+	Count     int
+	Seed      int64
+	BatchSize int
+}
+
+var seedFirstNames = []string{"Awa", "Moussa", "Fatou", "Ibrahima", "Aminata", "Cheikh", "Mariama", "Ousmane", "Khady", "Mamadou", "Ndeye", "Abdoulaye"}
+
+var seedLastNames = []string{"Diop", "Ndiaye", "Fall", "Sow", "Ba", "Diallo", "Gueye", "Faye", "Sarr", "Cisse", "Mbaye", "Kane"}
+
+var seedCities = []string{"Dakar", "Thies", "Saint-Louis", "Ziguinchor", "Kaolack", "Touba", "Mbour", "Louga", "Tambacounda", "Kolda"}
+
+var seedWords = []string{"lorem", "ipsum", "dolor", "sit", "amet", "consectetur", "adipiscing", "elit", "sed", "do", "eiusmod", "tempor", "incididunt", "labore", "dolore", "magna", "aliqua"}
+
+// seeder generates the records of a collection from its schema.
+type seeder struct {
+	random     *rand.Rand
+	schema     *CollectionSchema
+	references map[string][]string
+	index      int
+}
+
+// validationRules splits a validate tag into its rules, keyed by name.
+func validationRules(tag string) map[string]string {
+	rules := make(map[string]string)
+	for _, rule := range strings.Split(tag, ",") {
+		if rule == "" {
+			continue
+		}
+		name, param, _ := strings.Cut(rule, "=")
+		rules[name] = param
+	}
+	return rules
+}
+
+// ruleBounds returns the bounds set by min/max, gte/lte, gt/lt and len, or the defaults.
+func ruleBounds(rules map[string]string, min, max float64) (float64, float64) {
+	for _, name := range []string{"min", "gte", "len"} {
+		if value, err := strconv.ParseFloat(rules[name], 64); err == nil {
+			min = value
+		}
+	}
+	if value, err := strconv.ParseFloat(rules["gt"], 64); err == nil {
+		min = value + 1
+	}
+	for _, name := range []string{"max", "lte", "len"} {
+		if value, err := strconv.ParseFloat(rules[name], 64); err == nil {
+			max = value
+		}
+	}
+	if value, err := strconv.ParseFloat(rules["lt"], 64); err == nil {
+		max = value - 1
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+func (s *seeder) pick(values []string) string {
+	return values[s.random.Intn(len(values))]
+}
+
+func (s *seeder) words(count int) string {
+	words := make([]string, count)
+	for i := range words {
+		words[i] = s.pick(seedWords)
+	}
+	return strings.Join(words, " ")
+}
+
+// stringValue generates a string that looks like what the field name suggests.
+func (s *seeder) stringValue(field utils.FieldDefinition, rules map[string]string) string {
+	name := strings.ToLower(field.JSONTag)
+	first, last := s.pick(seedFirstNames), s.pick(seedLastNames)
+	var value string
+	switch {
+	case hasRule(rules, "email") || strings.Contains(name, "email"):
+		value = fmt.Sprintf("%s.%s%d@example.com", strings.ToLower(first), strings.ToLower(last), s.index)
+	case hasRule(rules, "url") || strings.Contains(name, "url"):
+		value = fmt.Sprintf("https://example.com/%s/%d", s.pick(seedWords), s.index)
+	case strings.Contains(name, "first_name"):
+		value = first
+	case strings.Contains(name, "last_name"):
+		value = last
+	case strings.Contains(name, "name"):
+		value = first + " " + last
+	case strings.Contains(name, "city"), strings.Contains(name, "location"), strings.Contains(name, "place"), strings.Contains(name, "address"):
+		value = s.pick(seedCities)
+	case strings.Contains(name, "phone"):
+		value = fmt.Sprintf("+2217%08d", s.random.Intn(100000000))
+	case strings.HasSuffix(name, "_at"), strings.Contains(name, "date"), strings.Contains(name, "day"):
+		start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		value = start.Add(time.Duration(s.random.Int63n(int64(25 * 365 * 24 * time.Hour)))).Format(time.RFC3339)
+	default:
+		value = s.words(1 + s.random.Intn(4))
+	}
+
+	if field.DBTag == "unique" && !strings.Contains(value, fmt.Sprint(s.index)) {
+		value = fmt.Sprintf("%s %d", value, s.index)
+	}
+	if _, bounded := rules["max"]; bounded || hasRule(rules, "len") || hasRule(rules, "min") {
+		min, max := ruleBounds(rules, 0, float64(len(value)))
+		for len(value) < int(min) {
+			value += " " + s.pick(seedWords)
+		}
+		if len(value) > int(max) {
+			// Keep the end, which holds the index that makes unique values unique
+			value = value[len(value)-int(max):]
+		}
+	}
+	return value
+}
+
+func hasRule(rules map[string]string, name string) bool {
+	_, ok := rules[name]
+	return ok
+}
+
+// numberValue draws a number within the bounds of the validation rules.
+func (s *seeder) numberValue(rules map[string]string, integer bool) interface{} {
+	min, max := ruleBounds(rules, 0, 100)
+	if integer {
+		return int64(min) + s.random.Int63n(int64(max)-int64(min)+1)
+	}
+	return min + s.random.Float64()*(max-min)
+}
+
+// value generates the json value of a field, or nil when the field should be left out.
+func (s *seeder) value(field utils.FieldDefinition) (interface{}, error) {
+	if references, ok := s.references[field.JSONTag]; ok {
+		return s.pick(references), nil
+	}
+	if field.DBTag == "autogenerate" || field.SchemaType == "computed" {
+		return nil, nil
+	}
+	rules := validationRules(field.Validation)
+	if oneOf, ok := rules["oneof"]; ok {
+		choice := s.pick(strings.Fields(oneOf))
+		if enum, ok := s.schema.Enums[field.Type]; ok && enum.Type != "string" {
+			var number float64
+			_, err := fmt.Sscan(choice, &number)
+			return number, err
+		}
+		return choice, nil
+	}
+	if field.SchemaType == "geo_point" {
+		longitude := -17.5 + s.random.Float64()*5
+		latitude := 12.3 + s.random.Float64()*4.3
+		return map[string]interface{}{"type": "Point", "coordinates": []float64{longitude, latitude}}, nil
+	}
+	if nested, ok := s.schema.Structs[field.Type]; ok {
+		return s.record(nested)
+	}
+
+	switch field.Type {
+	case "string":
+		return s.stringValue(field, rules), nil
+	case "int":
+		return s.numberValue(rules, true), nil
+	case "float64":
+		return s.numberValue(rules, false), nil
+	case "bool":
+		return s.random.Intn(2) == 0, nil
+	case "[]string":
+		return []string{s.pick(seedWords), s.pick(seedWords)}, nil
+	case "[]int":
+		return []int64{s.random.Int63n(100), s.random.Int63n(100)}, nil
+	case "[]float64":
+		return []float64{s.random.Float64() * 100, s.random.Float64() * 100}, nil
+	case "primitive.ObjectID":
+		var id primitive.ObjectID
+		s.random.Read(id[:])
+		return id.Hex(), nil
+	}
+	return nil, nil
+}
+
+// record generates the json values of a struct. Fields are generated in name order so that
+// the same seed always gives the same records.
+func (s *seeder) record(definition *utils.StructDefinition) (map[string]interface{}, error) {
+	fields := append([]utils.FieldDefinition(nil), definition.Fields...)
+	sort.Slice(fields, func(i, j int) bool { return fields[i].JSONTag < fields[j].JSONTag })
+	record := make(map[string]interface{})
+	for _, field := range fields {
+		value, err := s.value(field)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", field.JSONTag, err)
+		}
+		if value != nil {
+			record[field.JSONTag] = value
+		}
+	}
+	return record, nil
+}
+
+// seedReferences reads the IDs that foreign keys of the collection can point to.
+func seedReferences(ctx context.Context, db MongoDBconnector, modelConfig ModelConfig) (map[string][]string, error) {
+	references := make(map[string][]string)
+	for _, foreignKey := range modelConfig.ContentConfigs.ForeignKeys {
+		var ids []string
+		// Sorted before being capped, so that the same records are read every time
+		opts := options.Find().
+			SetProjection(bson.M{"_id": 1}).
+			SetSort(bson.D{{Key: "_id", Value: 1}}).
+			SetLimit(maxSeedReferences)
+		err := db.IterateRecords(ctx, foreignKey.Model, bson.M{}, func(record bson.M) error {
+			if id, ok := record["_id"].(primitive.ObjectID); ok {
+				ids = append(ids, id.Hex())
+			}
+			return nil
+		}, opts)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("%s references %s, which has no records to point to", foreignKey.Name, foreignKey.Model)
+		}
+		references[foreignKey.Name] = ids
+	}
+	return references, nil
+}
+
+// SeedCollection inserts fake records generated from the schema of a collection. Values
+// satisfy the validate tags of the model and foreign keys point to existing records. The
+// same seed gives the same records, as long as the referenced collections don't change.
+func SeedCollection(ctx context.Context, db MongoDBconnector, collection string, options SeedOptions) (int, error) {
+	config, ok := HandlerConfigRegistry[collection]
+	if !ok {
+		return 0, fmt.Errorf("collection %s is not served", collection)
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultSeedBatchSize
+	}
+	schema, err := loadSchema(collection)
+	if err != nil {
+		return 0, err
+	}
+	var modelConfig ModelConfig
+	if err := loadConfig(collection, &modelConfig); err != nil {
+		return 0, err
+	}
+	references, err := seedReferences(ctx, db, modelConfig)
+	if err != nil {
+		return 0, err
+	}
+
+	generator := &seeder{
+		random:     rand.New(rand.NewSource(options.Seed)),
+		schema:     schema,
+		references: references,
+	}
+	inserted := 0
+	var batch []interface{}
+	for i := 0; i < options.Count; i++ {
+		generator.index = i + 1
+		values, err := generator.record(schema.Root)
+		if err != nil {
+			return inserted, err
+		}
+		model, err := importRecord(config, values)
+		if err != nil {
+			return inserted, fmt.Errorf("record %d doesn't fit the model: %w", i+1, err)
+		}
+		batch = append(batch, model)
+		if len(batch) == options.BatchSize || i == options.Count-1 {
+			if err := db.BulkCreateRecords(ctx, collection, batch); err != nil {
+				return inserted, err
+			}
+			inserted += len(batch)
+			batch = nil
+		}
+	}
+	return inserted, nil
+}
@@ -1,12 +1,16 @@
 package core
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/lodjim/naboobase/configs"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Server struct {
@@ -16,17 +20,21 @@ type Server struct {
 }
 
 func (server *Server) Init(ip string, port int) {
+	// Tokens are signed with it, a server without a .env stops here rather than on its first
+	// login
+	configs.GetSecretKey()
 	server.IP = ip
 	server.Port = port
 	server.Router = gin.Default()
 	server.Router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"GET", "POST", "PATCH", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", requestIdHeader, idempotencyKeyHeader},
+		ExposeHeaders:    []string{"Content-Length", requestIdHeader, idempotencyReplayedHeader},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
+	server.Router.Use(RequestId())
 
 	err := server.Router.SetTrustedProxies([]string{"127.0.0.1"})
 	if err != nil {
@@ -34,6 +42,24 @@ func (server *Server) Init(ip string, port int) {
 	}
 }
 
+const requestIdHeader = "X-Request-ID"
+
+const requestIdKey = "request_id"
+
+// RequestId tags every request with the ID sent by the client in X-Request-ID, or a new one,
+// and sends it back in the response.
+func RequestId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIdHeader)
+		if id == "" {
+			id = primitive.NewObjectID().Hex()
+		}
+		c.Set(requestIdKey, id)
+		c.Header(requestIdHeader, id)
+		c.Next()
+	}
+}
+
 func (server *Server) AttachMiddleware(middleware ...gin.HandlerFunc) {
 	server.Router.Use(middleware...)
 }
@@ -68,8 +94,16 @@ func (server *Server) AttachAuthenticationLayer(db MongoDBconnector) {
 }
 
 func (server *Server) AutoServe(db MongoDBconnector) {
+	// The encrypted and invisible fields come from the schemas, none can be missing
+	if err := loadSchemas(); err != nil {
+		log.Fatal(err)
+	}
 	var newEndpoints []Endpoint
 	superUserManagement := SuperUserManagement{}
+	batchProcessor := BatchProcessor{}
+	backupManagement := BackupManagement{}
+	auditManagement := AuditManagement{}
+	slowQueryManagement := SlowQueryManagement{}
 	for k, v := range AutoEndpointFuncRegistry {
 		information := strings.Split(k, "-")
 		if len(information) == 2 {
@@ -88,8 +122,43 @@ func (server *Server) AutoServe(db MongoDBconnector) {
 			newEndpoints = append(newEndpoints, newEndpoint)
 		}
 	}
-	server.AttachEndpoints(newEndpoints)
-	server.AttachEndpoints(superUserManagement.Init(db))
+	for collection, config := range HandlerConfigRegistry {
+		var modelConfig ModelConfig
+		if err := loadConfig(collection, &modelConfig); err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+		newEndpoints = append(newEndpoints, Endpoint{
+			Method:  "GET",
+			Path:    fmt.Sprintf("/%s/aggregate", collection),
+			Handler: GenerateAggregateHandler(db, config),
+		})
+		if modelConfig.ContentConfigs.History {
+			newEndpoints = append(newEndpoints,
+				Endpoint{Method: "GET", Path: fmt.Sprintf("/%s/:id/history", collection), Handler: GenerateHistoryHandler(db, config)},
+				Endpoint{Method: "GET", Path: fmt.Sprintf("/%s/:id/history/:version", collection), Handler: GenerateHistoryVersionHandler(db, config)},
+				Endpoint{Method: "POST", Path: fmt.Sprintf("/%s/:id/revert/:version", collection), Handler: GenerateRevertHandler(db, config)},
+			)
+		}
+		if modelConfig.ContentConfigs.Bulk.Enabled {
+			newEndpoints = append(newEndpoints,
+				Endpoint{Method: "POST", Path: fmt.Sprintf("/%s/bulk", collection), Handler: GenerateBulkCreateHandler(db, config)},
+				Endpoint{Method: "PATCH", Path: fmt.Sprintf("/%s", collection), Handler: GenerateBulkUpdateHandler(db, config)},
+				Endpoint{Method: "DELETE", Path: fmt.Sprintf("/%s", collection), Handler: GenerateBulkDeleteHandler(db, config)},
+			)
+		}
+	}
+	server.AttachEndpoints(idempotentEndpoints(db, newEndpoints))
+	EnsureCollectionIndexes(db)
+	server.AttachEndpoints(idempotentEndpoints(db, superUserManagement.Init(db)))
+	server.AttachEndpoints(idempotentEndpoints(db, batchProcessor.Init(db)))
+	server.AttachEndpoints(backupManagement.Init(db))
+	server.AttachEndpoints(auditManagement.Init(db))
+	server.AttachEndpoints(slowQueryManagement.Init(db))
+	if interval := configs.GetBackupInterval(); interval > 0 {
+		go ScheduleBackups(context.Background(), db, configs.GetBackupDir(), interval, configs.GetBackupRetention())
+	}
+	go ScheduleTTLSweeps(context.Background(), db, configs.GetTTLSweepInterval())
 }
 
 func (server *Server) RunServer() {
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The sort of the list endpoint of the collections without a default sort
+const fallbackSort = "-_id"
+
+// parseSort turns a sort parameter such as -created_at,last_name into the sort of a list
+// query. Fields are ascending unless prefixed with -, _score sorts by relevance when
+// searching, and _id is added last so that pages don't overlap when values repeat.
+func parseSort(collection string, superuser bool, searching bool, expression string) (bson.D, error) {
+	schema, err := loadSchema(collection)
+	if err != nil {
+		return nil, err
+	}
+	sort := bson.D{}
+	seen := make(map[string]bool)
+	direction := -1
+	for _, term := range strings.Split(expression, ",") {
+		term = strings.TrimSpace(term)
+		direction = 1
+		if strings.HasPrefix(term, "-") {
+			direction = -1
+			term = term[1:]
+		} else if strings.HasPrefix(term, "+") {
+			term = term[1:]
+		}
+		if term == "" {
+			return nil, errors.New("Empty sort field")
+		}
+		if seen[term] {
+			return nil, fmt.Errorf("The sort field %s is used more than once", term)
+		}
+		seen[term] = true
+		if term == searchScoreField {
+			if !searching {
+				return nil, errors.New("Sorting by score requires a search")
+			}
+			sort = append(sort, bson.E{Key: searchScoreField, Value: bson.M{"$meta": "textScore"}})
+			direction = -1
+			continue
+		}
+		if err := checkSortField(collection, superuser, term); err != nil {
+			return nil, err
+		}
+		if err := checkComputedQuery(schema, bson.M{}, term); err != nil {
+			return nil, err
+		}
+		if field, ok := schema.Field(term); ok && field.Encryption != "" {
+			return nil, fmt.Errorf("The encrypted field %s can't be used to sort", term)
+		}
+		sort = append(sort, bson.E{Key: term, Value: direction})
+	}
+	if !seen["_id"] {
+		sort = append(sort, bson.E{Key: "_id", Value: direction})
+	}
+	return sort, nil
+}
+
+// legacySort converts the sort_field and sort_order parameters to the sort syntax. As before
+// the sort parameter, the field defaults to _id and the order to descending.
+func legacySort(sortField string, sortOrder string) string {
+	if sortField == "" {
+		sortField = "_id"
+	}
+	if sortOrder == "1" {
+		return sortField
+	}
+	return "-" + sortField
+}
@@ -0,0 +1,22 @@
+package core
+
+import "testing"
+
+func TestLegacySort(t *testing.T) {
+	tests := []struct {
+		sortField string
+		sortOrder string
+		want      string
+	}{
+		{"created_at", "1", "created_at"},
+		{"created_at", "-1", "-created_at"},
+		{"created_at", "", "-created_at"},
+		{"", "1", "_id"},
+		{"", "-1", "-_id"},
+	}
+	for _, test := range tests {
+		if got := legacySort(test.sortField, test.sortOrder); got != test.want {
+			t.Errorf("legacySort(%q, %q) = %q, want %q", test.sortField, test.sortOrder, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/lodjim/naboobase/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const defaultImportBatchSize = 500
+
+type ImportOptions struct {
+	Format    string // "jsonl" or "csv"
+	DryRun    bool   // Validate every row without writing anything
+	BatchSize int    // Number of records written per ImportRecords call
+}
+
+type ImportRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type ImportReport struct {
+	Total    int              `json:"total"`
+	Imported int              `json:"imported"`
+	Errors   []ImportRowError `json:"errors"`
+}
+
+// exportColumns returns the top-level fields of a collection in a stable order.
+func exportColumns(collection string) ([]string, error) {
+	schema, err := loadSchema(collection)
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, 0, len(schema.Root.Fields))
+	for _, field := range schema.Root.Fields {
+		if (field.SchemaType == "computed" && !field.Stored) || field.Hidden || field.WriteOnly {
+			continue
+		}
+		columns = append(columns, field.JSONTag)
+	}
+	sort.Strings(columns)
+	return columns, nil
+}
+
+func csvValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case primitive.ObjectID:
+		return v.Hex(), nil
+	case bool, int32, int64, float64:
+		return fmt.Sprintf("%v", v), nil
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(encoded), nil
+	}
+}
+
+// ExportCollection writes the records of a collection matching the filter to w, as JSON
+// lines or as CSV with one column per top-level field of the schema.
+func ExportCollection(ctx context.Context, db MongoDBconnector, collection string, format string, filterSearch string, w io.Writer) (int, error) {
+	if _, ok := HandlerConfigRegistry[collection]; !ok {
+		return 0, fmt.Errorf("collection %s is not served", collection)
+	}
+	filter := bson.M{}
+	if filterSearch != "" {
+		query, err := compileFilter(collection, true, filterSearch)
+		if err != nil {
+			return 0, err
+		}
+		if err := rejectRelations(collection, query); err != nil {
+			return 0, err
+		}
+		filter = query
+	}
+
+	count := 0
+	switch format {
+	case "jsonl":
+		encoder := json.NewEncoder(w)
+		// Exports are run by operators, who see the admin-only fields
+		invisible, err := invisibleFields(collection, true)
+		if err != nil {
+			return 0, err
+		}
+		err = db.IterateRecords(ctx, collection, filter, func(record bson.M) error {
+			count++
+			return encoder.Encode(withoutFields(record, invisible))
+		})
+		return count, err
+	case "csv":
+		columns, err := exportColumns(collection)
+		if err != nil {
+			return 0, err
+		}
+		writer := csv.NewWriter(w)
+		if err := writer.Write(columns); err != nil {
+			return 0, err
+		}
+		err = db.IterateRecords(ctx, collection, filter, func(record bson.M) error {
+			row := make([]string, len(columns))
+			for i, column := range columns {
+				value, err := csvValue(record[column])
+				if err != nil {
+					return err
+				}
+				row[i] = value
+			}
+			count++
+			return writer.Write(row)
+		})
+		writer.Flush()
+		if err == nil {
+			err = writer.Error()
+		}
+		return count, err
+	default:
+		return 0, fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+type importRow struct {
+	values map[string]interface{}
+	err    error
+}
+
+// readImportRows decodes the rows of an import file into json-like maps.
+func readImportRows(collection string, r io.Reader, format string) ([]importRow, error) {
+	var rows []importRow
+	switch format {
+	case "jsonl":
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var values map[string]interface{}
+			err := json.Unmarshal([]byte(line), &values)
+			if err != nil {
+				err = fmt.Errorf("invalid JSON: %w", err)
+			}
+			rows = append(rows, importRow{values: values, err: err})
+		}
+		return rows, scanner.Err()
+	case "csv":
+		schema, err := loadSchema(collection)
+		if err != nil {
+			return nil, err
+		}
+		reader := csv.NewReader(r)
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return nil, nil
+		}
+		header := records[0]
+		for _, record := range records[1:] {
+			row := make(map[string]interface{})
+			for i, column := range header {
+				if i >= len(record) || record[i] == "" {
+					continue
+				}
+				field, ok := schema.Field(column)
+				if !ok {
+					row[column] = record[i]
+					continue
+				}
+				row[column] = parseCSVValue(field.Type, record[i])
+			}
+			rows = append(rows, importRow{values: row})
+		}
+		return rows, nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+}
+
+// parseCSVValue converts a CSV cell to the json value expected by the field type. Cells that
+// can't be converted are kept as strings so that validation reports them.
+func parseCSVValue(fieldType string, cell string) interface{} {
+	switch fieldType {
+	case "int":
+		if value, err := strconv.ParseInt(cell, 10, 64); err == nil {
+			return value
+		}
+	case "float64":
+		if value, err := strconv.ParseFloat(cell, 64); err == nil {
+			return value
+		}
+	case "bool":
+		if value, err := strconv.ParseBool(cell); err == nil {
+			return value
+		}
+	case "string", "primitive.ObjectID":
+		return cell
+	default:
+		var value interface{}
+		if err := json.Unmarshal([]byte(cell), &value); err == nil {
+			return value
+		}
+	}
+	return cell
+}
+
+// ImportCollection checks every row of an import file against the validate tags and the
+// unique fields of the collection model, then writes the valid rows in batches. Invalid rows
+// are reported instead of stopping the import.
+func ImportCollection(ctx context.Context, db MongoDBconnector, collection string, r io.Reader, options ImportOptions) (*ImportReport, error) {
+	config, ok := HandlerConfigRegistry[collection]
+	if !ok {
+		return nil, fmt.Errorf("collection %s is not served", collection)
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultImportBatchSize
+	}
+	rows, err := readImportRows(collection, r, options.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{Total: len(rows)}
+	seen := make(map[string]int)
+	var batch []interface{}
+	var batchRows []int
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		defer func() {
+			batch, batchRows = nil, nil
+		}()
+		if options.DryRun {
+			report.Imported += len(batch)
+			return
+		}
+		// Rows are inserted unordered, so that one refused by the database doesn't stop the
+		// rest of its batch
+		failed, err := db.ImportRecords(ctx, collection, batch)
+		if err != nil {
+			for _, row := range batchRows {
+				report.Errors = append(report.Errors, ImportRowError{Row: row, Error: "batch failed: " + err.Error()})
+			}
+			return
+		}
+		for i, row := range batchRows {
+			if err, ok := failed[i]; ok {
+				report.Errors = append(report.Errors, ImportRowError{Row: row, Error: err.Error()})
+				continue
+			}
+			report.Imported++
+		}
+	}
+
+	for i, row := range rows {
+		rowNumber := i + 1
+		if row.err != nil {
+			report.Errors = append(report.Errors, ImportRowError{Row: rowNumber, Error: row.err.Error()})
+			continue
+		}
+		model, err := importRecord(config, row.values)
+		if err == nil {
+			err = db.CheckUnique(ctx, collection, model)
+		}
+		if err == nil {
+			for _, field := range utils.GetTaggedFields(model, "unique") {
+				value, _ := utils.Get(field, model)
+				key := fmt.Sprintf("%s=%v", field, value)
+				if previous, exists := seen[key]; exists {
+					err = fmt.Errorf("For the Field: %s the value %v is already used by row %d", field, value, previous)
+					break
+				}
+				seen[key] = rowNumber
+			}
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, ImportRowError{Row: rowNumber, Error: err.Error()})
+			continue
+		}
+		batch = append(batch, model)
+		batchRows = append(batchRows, rowNumber)
+		if len(batch) >= options.BatchSize {
+			flush()
+		}
+	}
+	flush()
+	return report, nil
+}
+
+func importRecord(config HandlerConfig, row map[string]interface{}) (interface{}, error) {
+	encoded, err := json.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	model := config.NewModel()
+	decoder := json.NewDecoder(strings.NewReader(string(encoded)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(model); err != nil {
+		return nil, err
+	}
+	if err := validate.Struct(model); err != nil {
+		var validationErrors validator.ValidationErrors
+		if errors.As(err, &validationErrors) {
+			return nil, validationErrors
+		}
+		return nil, err
+	}
+	if err := computeStoredFields(config.Collection, model); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
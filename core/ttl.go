@@ -0,0 +1,163 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TTLConfig expires the records of a collection Duration after the date of Field.
+type TTLConfig struct {
+	Field    string `json:"field"`
+	Duration string `json:"duration"`
+}
+
+// The native TTL index only catches the records the sweeper missed, since its deletes skip
+// the audit log and the history
+const ttlIndexGrace = time.Hour
+
+// Number of expired records deleted per collection at each sweep
+const ttlSweepBatchSize = 500
+
+var errSweepBatchFull = errors.New("sweep batch full")
+
+// expiry returns the field and the lifetime of the records, ok is false when the collection
+// doesn't expire its records.
+func (ttl TTLConfig) expiry(collection string) (string, time.Duration, bool, error) {
+	if ttl.Field == "" {
+		return "", 0, false, nil
+	}
+	duration, err := time.ParseDuration(ttl.Duration)
+	if err != nil || duration <= 0 {
+		return "", 0, false, fmt.Errorf("invalid ttl duration %q of %s", ttl.Duration, collection)
+	}
+	schema, err := loadSchema(collection)
+	if err != nil {
+		return "", 0, false, err
+	}
+	field, ok := schema.Field(ttl.Field)
+	if !ok {
+		return "", 0, false, fmt.Errorf("unknown ttl field %s of %s", ttl.Field, collection)
+	}
+	if field.Encryption != "" {
+		return "", 0, false, fmt.Errorf("the ttl field %s of %s can't be encrypted", ttl.Field, collection)
+	}
+	return ttl.Field, duration, true, nil
+}
+
+// ensureTTLIndex creates the TTL index of a collection whose _config sets a ttl. It only
+// applies to the fields stored as dates.
+func ensureTTLIndex(ctx context.Context, db MongoDBconnector, collection string, modelConfig ModelConfig) error {
+	field, duration, ok, err := modelConfig.ContentConfigs.TTL.expiry(collection)
+	if err != nil || !ok {
+		return err
+	}
+	name := field + "_ttl"
+	index := mongo.IndexModel{
+		Keys: bson.D{{Key: field, Value: 1}},
+		Options: options.Index().
+			SetName(name).
+			SetExpireAfterSeconds(int32((duration + ttlIndexGrace).Seconds())),
+	}
+	if err := db.EnsureIndexes(ctx, collection, index); err != nil {
+		// The duration changed since the index was created, rebuild it
+		if dropErr := db.DropIndex(ctx, collection, name); dropErr != nil {
+			return err
+		}
+		return db.EnsureIndexes(ctx, collection, index)
+	}
+	return nil
+}
+
+// expiredFilter matches the records whose field is older than the cutoff, whether it is
+// stored as a date or as an RFC 3339 string. Strings are converted to dates by the database
+// rather than compared as text, which would get their offsets and fractions wrong; the ones
+// that aren't dates never expire.
+func expiredFilter(field string, cutoff time.Time) bson.M {
+	parsed := bson.M{"$convert": bson.M{"input": "$" + field, "to": "date", "onError": nil, "onNull": nil}}
+	return bson.M{"$or": []bson.M{
+		{field: bson.M{"$lt": cutoff}},
+		{
+			field: bson.M{"$type": "string"},
+			"$expr": bson.M{"$let": bson.M{
+				"vars": bson.M{"date": parsed},
+				"in":   bson.M{"$and": bson.A{bson.M{"$ne": bson.A{"$$date", nil}}, bson.M{"$lt": bson.A{"$$date", cutoff}}}},
+			}},
+		},
+	}}
+}
+
+// SweepExpiredRecords deletes the expired records of the collections whose _config sets a
+// ttl. Each record is deleted like a client would, so the delete is audited and saved in the
+// history. A collection that can't be swept doesn't stop the others, the first error is
+// returned along with the number of records deleted.
+func SweepExpiredRecords(ctx context.Context, db MongoDBconnector) (int, error) {
+	deleted := 0
+	var firstErr error
+	for collection, config := range HandlerConfigRegistry {
+		var modelConfig ModelConfig
+		if err := loadConfig(collection, &modelConfig); err != nil {
+			continue
+		}
+		field, duration, ok, err := modelConfig.ContentConfigs.TTL.expiry(collection)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if !ok {
+			continue
+		}
+		var ids []primitive.ObjectID
+		err = db.IterateRecords(ctx, collection, expiredFilter(field, time.Now().UTC().Add(-duration)), func(record bson.M) error {
+			if id, ok := record["_id"].(primitive.ObjectID); ok {
+				ids = append(ids, id)
+			}
+			if len(ids) == ttlSweepBatchSize {
+				return errSweepBatchFull
+			}
+			return nil
+		})
+		if err != nil && err != errSweepBatchFull {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", collection, err)
+			}
+			continue
+		}
+		for _, id := range ids {
+			// The record may have been deleted since, by a client or by the TTL index
+			if err := deleteRecord(ctx, db, collection, SystemActor, id, config.NewModel()); err != nil {
+				fmt.Printf("Error deleting the expired record %s of %s: %s\n", id.Hex(), collection, err.Error())
+				continue
+			}
+			deleted++
+		}
+	}
+	return deleted, firstErr
+}
+
+// ScheduleTTLSweeps deletes the expired records every interval until ctx is cancelled.
+func ScheduleTTLSweeps(ctx context.Context, db MongoDBconnector, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sweepCtx, cancel := context.WithTimeout(ctx, interval)
+			deleted, err := SweepExpiredRecords(sweepCtx, db)
+			cancel()
+			if err != nil {
+				fmt.Printf("Expired records sweep failed: %s\n", err.Error())
+			}
+			if deleted > 0 {
+				fmt.Printf("Deleted %d expired records\n", deleted)
+			}
+		}
+	}
+}
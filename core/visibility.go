@@ -0,0 +1,80 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lodjim/naboobase/utils"
+)
+
+// isVisible tells whether a field can be sent to a client. Hidden and write-only fields never
+// are, admin-only ones only to superusers.
+func isVisible(field utils.FieldDefinition, superuser bool) bool {
+	if field.Hidden || field.WriteOnly {
+		return false
+	}
+	return !field.AdminOnly || superuser
+}
+
+// invisibleFields returns the json names of the top-level fields of a collection a client
+// can't see. Without the schema of the collection nothing can be sent.
+func invisibleFields(collection string, superuser bool) (map[string]bool, error) {
+	schema, err := loadSchema(collection)
+	if err != nil {
+		return nil, fmt.Errorf("the visible fields of %s: %w", collection, err)
+	}
+	var fields map[string]bool
+	for _, field := range schema.Root.Fields {
+		if isVisible(field, superuser) {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]bool)
+		}
+		fields[field.JSONTag] = true
+	}
+	return fields, nil
+}
+
+// visibleDocument drops from a document of a collection the fields a client can't see.
+// Every record sent out goes through it, whichever endpoint reads it.
+func visibleDocument(collection string, superuser bool, document map[string]interface{}) (map[string]interface{}, error) {
+	invisible, err := invisibleFields(collection, superuser)
+	if err != nil {
+		return nil, err
+	}
+	return withoutFields(document, invisible), nil
+}
+
+func withoutFields(document map[string]interface{}, fields map[string]bool) map[string]interface{} {
+	if len(fields) == 0 {
+		return document
+	}
+	visible := make(map[string]interface{}, len(document))
+	for key, value := range document {
+		if !fields[key] {
+			visible[key] = value
+		}
+	}
+	return visible
+}
+
+// renderVisible turns a model or a response of a collection into the document a client sees.
+func renderVisible(collection string, superuser bool, record interface{}) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(encoded, &document); err != nil {
+		return nil, err
+	}
+	return visibleDocument(collection, superuser, document)
+}
+
+// requestIsSuperUser tells whether a request comes from a superuser, whether or not the
+// endpoint requires authentication.
+func requestIsSuperUser(c *gin.Context) bool {
+	return actorFromRequest(c).IsSuperUser
+}
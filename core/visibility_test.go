@@ -0,0 +1,36 @@
+package core
+
+import "testing"
+
+func TestVisibleDocument(t *testing.T) {
+	inSchemaDir(t, map[string]string{
+		"member": `{
+			"name": {"value": "Text"},
+			"password": {"value": "Text", "hidden": true},
+			"pin": {"value": "Text", "write_only": true},
+			"notes": {"value": "Text", "admin_only": true}
+		}`,
+	})
+	document := map[string]interface{}{"name": "a", "password": "b", "pin": "c", "notes": "d"}
+	visible, err := visibleDocument("member", false, document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visible) != 1 || visible["name"] != "a" {
+		t.Errorf("a client sees %v", visible)
+	}
+	visible, err = visibleDocument("member", true, document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visible) != 2 || visible["notes"] != "d" {
+		t.Errorf("a superuser sees %v", visible)
+	}
+}
+
+func TestVisibleDocumentFailsClosed(t *testing.T) {
+	inSchemaDir(t, nil)
+	if visible, err := visibleDocument("member", true, map[string]interface{}{"password": "b"}); err == nil {
+		t.Errorf("without its schema the document was sent as %v", visible)
+	}
+}
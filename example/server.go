@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/lodjim/naboobase/controllers"
 	"github.com/lodjim/naboobase/core"
@@ -9,16 +12,26 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func HealthCheck() gin.HandlerFunc {
+func HealthCheck(db core.MongoDBconnector) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		ctx.String(http.StatusOK, "Good")
+		stateCtx, cancel := context.WithTimeout(ctx.Request.Context(), 2*time.Second)
+		defer cancel()
+		state := db.State(stateCtx)
+		if state != core.StateConnected {
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"database": state})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"database": state})
 	}
 }
 
 var dbConnector = core.MongoDBconnector{}
 
 func main() {
-	_ = dbConnector.Connect("naboobase")
+	if err := dbConnector.Connect("naboobase"); err != nil {
+		log.Fatal(err)
+	}
+	defer dbConnector.Close(context.Background())
 	myApi := core.Server{}
 	myApi.Init("localhost", 1555)
 	myApi.AttachEndpoints([]core.Endpoint{
@@ -30,7 +43,7 @@ func main() {
 		{
 			Method:  "GET",
 			Path:    "/health",
-			Handler: HealthCheck(),
+			Handler: HealthCheck(dbConnector),
 		},
 	})
 	myApi.AttachAuthenticationLayer(dbConnector)
@@ -13,10 +13,11 @@ type Volunter struct {
 	PlaceOfBirth           string             `json:"place_of_birth" bson:"place_of_birth" validate:"max=255"`
 	OtherTrainings         string             `json:"other_trainings" bson:"other_trainings" validate:"max=255"`
 	CreatedAt              string             `json:"created_at" bson:"created_at" validate:"max=255"`
-	CniVerso               string             `json:"cni_verso" bson:"cni_verso" validate:"max=255"`
+	CniVerso               string             `json:"cni_verso" bson:"cni_verso" db:"encrypted" validate:"max=255"`
 	FirstName              string             `json:"first_name" bson:"first_name" validate:"max=255"`
 	Sex                    string             `json:"sex" bson:"sex" db:"unique" validate:"max=255"`
-	Cni                    string             `json:"cni" bson:"cni" validate:"max=255"`
-	CniRecto               string             `json:"cni_recto" bson:"cni_recto" validate:"max=255"`
+	Cni                    string             `json:"cni" bson:"cni" db:"encrypted" validate:"max=255"`
+	CniRecto               string             `json:"cni_recto" bson:"cni_recto" db:"encrypted" validate:"max=255"`
 	Diplome                string             `json:"diplome" bson:"diplome" validate:"max=255"`
+	FullName               string             `json:"full_name" bson:"-"`
 }
@@ -19,4 +19,5 @@ type VolunterResponse struct {
 	PlaceOfBirth           string             `json:"place_of_birth" bson:"place_of_birth" validate:"max=255"`
 	OtherTrainings         string             `json:"other_trainings" bson:"other_trainings" validate:"max=255"`
 	CniVerso               string             `json:"cni_verso" bson:"cni_verso" validate:"max=255"`
+	FullName               string             `json:"full_name" bson:"-"`
 }
@@ -13,7 +13,11 @@ import (
 	"github.com/go-playground/validator/v10"
 )
 
-var jwtKey = []byte(configs.GetSecretKey())
+// jwtKey is read when a token is signed or verified, so that the package can be loaded without
+// a .env, by the tests and the CLI. Server.Init reads it at startup.
+func jwtKey() []byte {
+	return []byte(configs.GetSecretKey())
+}
 
 type JwtToken struct {
 	Token string `validate:"required,jwt"`
@@ -22,6 +26,7 @@ type JwtToken struct {
 type Claims struct {
 	Email       string `json:"email"`
 	Id          string `json:"id"`
+	Role        string `json:"role"`
 	IsSuperUser bool   `json:"is_super_user"`
 	IsVerified  bool   `json:"is_verified"`
 	jwt.StandardClaims
@@ -35,11 +40,12 @@ type RefreshTokenClaims struct {
 
 var validate = validator.New()
 
-func CreateToken(email string, id string, isVerified bool, isSuperUser bool) (string, error) {
+func CreateToken(email string, id string, role string, isVerified bool, isSuperUser bool) (string, error) {
 	expirationTime := time.Now().Add(24 * time.Hour)
 	claims := &Claims{
 		Email:       email,
 		Id:          id,
+		Role:        role,
 		IsSuperUser: isSuperUser,
 		IsVerified:  isVerified,
 		StandardClaims: jwt.StandardClaims{
@@ -47,7 +53,7 @@ func CreateToken(email string, id string, isVerified bool, isSuperUser bool) (st
 		},
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	tokenString, err := token.SignedString(jwtKey())
 	if err != nil {
 		return "", err
 	}
@@ -65,7 +71,7 @@ func CreateRefreshToken(email string, id string) (string, error) {
 		},
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	tokenString, err := token.SignedString(jwtKey())
 	if err != nil {
 		return "", err
 	}
@@ -80,7 +86,7 @@ func GetClaims(c *gin.Context) (*Claims, error) {
 	}
 	token := strings.TrimPrefix(authHeader, "Bearer ")
 	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
+		return jwtKey(), nil
 	})
 	if err != nil {
 		return nil, err
@@ -91,7 +97,7 @@ func GetClaims(c *gin.Context) (*Claims, error) {
 func VerifyJWT(tokenStr string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
+		return jwtKey(), nil
 	})
 	if err != nil {
 		return nil, err
@@ -124,7 +130,7 @@ func RequireAuth(c *gin.Context) {
 func VerifyRefreshJWT(tokenStr string) (*RefreshTokenClaims, error) {
 	claims := &RefreshTokenClaims{}
 	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
+		return jwtKey(), nil
 	})
 	if err != nil {
 		return nil, err
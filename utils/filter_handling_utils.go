@@ -3,7 +3,9 @@ package utils
 import (
 	"errors"
 	"fmt"
+	"math"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,37 +13,56 @@ import (
 	"github.com/alecthomas/participle/v2/lexer"
 	"github.com/expr-lang/expr"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var filterLexer = lexer.MustSimple([]lexer.SimpleRule{
 	{"Whitespace", `\s+`},
-	{"Operator", `&&|\|\||=|\!=|>|>=|<|<=|~|\!~`},
+	{"Operator", `\?!=|\?=|\?~|&&|\|\||!=|!~|>=|<=|=|>|<|~|!`},
 	{"Arithmetic", `\+|\-|\*|\/`},
-	{"Punct", `[\(\):]`},
+	{"Punct", `[\(\):,]`},
 	{"String", `"[^"]*"|'[^']*'`},
 	{"Number", `[0-9]+(\.[0-9]+)?([eE][+-]?[0-9]+)?`},
-	{"Bool", `true|false`},
-	{"Null", `null`},
-	{"Identifier", `[a-zA-Z_][a-zA-Z0-9_]*`},
-	{"Macro", `@[a-zA-Z_][a-zA-Z0-9_]*`},
+	{"Bool", `(true|false)\b`},
+	{"Null", `null\b`},
+	{"Identifier", `[a-zA-Z_][a-zA-Z0-9_]*(\.[a-zA-Z_][a-zA-Z0-9_]*)*`},
+	{"Macro", `@[a-zA-Z_][a-zA-Z0-9_]*(\.[a-zA-Z_][a-zA-Z0-9_]*)*`},
 })
 
 type Expression struct {
-	Logical *LogicalExpression `@@`
+	Or *OrExpression `@@`
 }
 
-type LogicalExpression struct {
-	Left     *ComparisonExpression `@@`
-	Operator string                `( @("&&" | "||")`
-	Right    *LogicalExpression    `@@ )?`
+// OrExpression and AndExpression make && bind tighter than ||
+type OrExpression struct {
+	And []*AndExpression `@@ ( "||" @@ )*`
+}
+
+type AndExpression struct {
+	Terms []*UnaryExpression `@@ ( "&&" @@ )*`
+}
+
+type UnaryExpression struct {
+	Not        *UnaryExpression      `  "!" @@`
+	Group      *OrExpression         `| "(" @@ ")"`
+	Comparison *ComparisonExpression `| @@`
 }
 
 type ComparisonExpression struct {
-	Pos      lexer.Position
-	Field    *Identifier      `@@`
-	Operator string           `@("=" | "!=" | ">" | ">=" | "<" | "<=" | "~" | "!~")`
-	Value    *ValueExpression `@@`
-	EndPos   lexer.Position
+	Pos       lexer.Position
+	Field     *Identifier        `@@`
+	Arguments []*SignedNumber    `( "(" @@ ( "," @@ )* ")"`
+	NotIn     bool               `| @"not"? "in"`
+	List      []*ValueExpression `"(" @@ ( "," @@ )* ")"`
+	Operator  string             `| @("=" | "!=" | ">" | ">=" | "<" | "<=" | "~" | "!~" | "?=" | "?!=" | "?~")`
+	Value     *ValueExpression   `@@ )`
+	EndPos    lexer.Position
+}
+
+// SignedNumber is an argument of a field function such as location:near(14.69, -17.44, 5000)
+type SignedNumber struct {
+	Negative bool    `@"-"?`
+	Value    float64 `@Number`
 }
 
 type Identifier struct {
@@ -58,6 +79,7 @@ type AdditiveValueExpression struct {
 	Left   *MultiplicativeValueExpression   `@@`
 	Ops    []string                         `( @("+" | "-")`
 	Rights []*MultiplicativeValueExpression `@@ )*`
+	EndPos lexer.Position
 }
 
 type MultiplicativeValueExpression struct {
@@ -81,83 +103,222 @@ var parser = participle.MustBuild[Expression](
 	participle.Elide("Whitespace"),
 )
 
+// FilterError is a filter that can't be turned into a query, Column being the position of
+// the faulty part in the filter, starting at 1.
+type FilterError struct {
+	Column  int
+	Message string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("invalid filter at column %d: %s", e.Column, e.Message)
+}
+
+// FilterOptions describes the collection a filter is compiled for.
+type FilterOptions struct {
+	// Field looks a field up by name, ok is false for the fields it doesn't know. Without it
+	// the fields aren't checked and the values aren't coerced.
+	Field func(name string) (FieldDefinition, bool)
+	// Enum looks the enum type of a field up by name
+	Enum func(name string) (EnumDefinition, bool)
+	// Macro returns the value of a macro other than @now and the calendar ones, named
+	// without its @, ok is false for the macros it doesn't know
+	Macro func(name string) (value interface{}, ok bool, err error)
+	// Location is the time zone of the calendar macros, UTC when nil
+	Location *time.Location
+}
+
+// ErrNoMatch is returned by FilterOptions.Macro for a macro without a value, such as the id
+// of the user of an anonymous request. The whole filter then matches nothing.
+var ErrNoMatch = errors.New("the macro has no value")
+
+// matchNothing returns the query of a filter that can't match any record
+func matchNothing() bson.M {
+	return bson.M{"_id": bson.M{"$in": bson.A{}}}
+}
+
+type filterCompiler struct {
+	filter       string
+	options      FilterOptions
+	now          time.Time
+	matchNothing bool
+}
+
 // TransformFilterToMongoQuery transforms a filter string to a MongoDB query
 func TransformFilterToMongoQuery(filter string) (bson.M, error) {
+	return TransformFilterToMongoQueryWithOptions(filter, FilterOptions{})
+}
+
+// TransformFilterToMongoQueryWithOptions transforms a filter string to a MongoDB query,
+// checking it against the fields of the options.
+func TransformFilterToMongoQueryWithOptions(filter string, options FilterOptions) (bson.M, error) {
 	// Parse the filter string into an AST
 	ast, err := parser.ParseString("", filter)
 	if err != nil {
+		var parseErr participle.Error
+		if errors.As(err, &parseErr) {
+			return nil, &FilterError{Column: parseErr.Position().Column, Message: parseErr.Message()}
+		}
 		return nil, fmt.Errorf("failed to parse filter: %v", err)
 	}
 
 	// Build the MongoDB query
-	query, err := buildQuery(ast.Logical, filter)
+	compiler := &filterCompiler{filter: filter, options: options, now: time.Now()}
+	query, err := compiler.buildOrQuery(ast.Or)
 	if err != nil {
-		return nil, fmt.Errorf("failed to build query: %v", err)
+		return nil, err
+	}
+	if compiler.matchNothing {
+		return matchNothing(), nil
 	}
 	return query, nil
 }
 
-// buildQuery constructs the MongoDB query from a LogicalExpression
-func buildQuery(logical *LogicalExpression, filter string) (bson.M, error) {
-	if logical.Operator == "" {
-		return buildComparisonQuery(logical.Left, filter)
+// buildOrQuery constructs the MongoDB query of alternatives, flattened into a single $or
+func (compiler *filterCompiler) buildOrQuery(or *OrExpression) (bson.M, error) {
+	if len(or.And) == 1 {
+		return compiler.buildAndQuery(or.And[0])
 	}
-
-	op := "$and"
-	if logical.Operator == "||" {
-		op = "$or"
+	clauses := make([]bson.M, 0, len(or.And))
+	for _, and := range or.And {
+		clause, err := compiler.buildAndQuery(and)
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, clause)
 	}
+	return bson.M{"$or": clauses}, nil
+}
 
-	leftQuery, err := buildComparisonQuery(logical.Left, filter)
-	if err != nil {
-		return nil, err
+// buildAndQuery constructs the MongoDB query of conditions, flattened into a single $and
+func (compiler *filterCompiler) buildAndQuery(and *AndExpression) (bson.M, error) {
+	if len(and.Terms) == 1 {
+		return compiler.buildUnaryQuery(and.Terms[0])
 	}
-
-	rightQuery, err := buildQuery(logical.Right, filter)
-	if err != nil {
-		return nil, err
+	clauses := make([]bson.M, 0, len(and.Terms))
+	for _, term := range and.Terms {
+		clause, err := compiler.buildUnaryQuery(term)
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, clause)
 	}
+	return bson.M{"$and": clauses}, nil
+}
 
-	return bson.M{op: []bson.M{leftQuery, rightQuery}}, nil
+// buildUnaryQuery constructs the MongoDB query of a negation, a group or a comparison
+func (compiler *filterCompiler) buildUnaryQuery(unary *UnaryExpression) (bson.M, error) {
+	switch {
+	case unary.Not != nil:
+		clause, err := compiler.buildUnaryQuery(unary.Not)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$nor": []bson.M{clause}}, nil
+	case unary.Group != nil:
+		return compiler.buildOrQuery(unary.Group)
+	default:
+		query, err := compiler.buildComparisonQuery(unary.Comparison)
+		if err != nil {
+			var filterErr *FilterError
+			if errors.As(err, &filterErr) {
+				return nil, err
+			}
+			return nil, &FilterError{Column: unary.Comparison.Pos.Column, Message: err.Error()}
+		}
+		return query, nil
+	}
 }
 
 // buildComparisonQuery constructs a MongoDB query from a ComparisonExpression
-func buildComparisonQuery(comp *ComparisonExpression, filter string) (bson.M, error) {
+func (compiler *filterCompiler) buildComparisonQuery(comp *ComparisonExpression) (bson.M, error) {
 	field := comp.Field.Name
 	modifier := ""
 	if comp.Field.Modifier != nil {
 		modifier = *comp.Field.Modifier
 	}
-
-	// Find the end position for the value expression
-	// If EndPos is not set, we need to find the end of this expression
-	// This could be until the next operator (&&, ||) or end of string
-	valueExprStr := ""
-	if comp.Value != nil {
-		startPos := comp.Value.Additive.Pos.Offset
-		endPos := comp.EndPos.Offset
-
-		// If the end position is invalid, find the next logical operator or use end of filter
-		if endPos == 0 || endPos <= startPos {
-			// Look for the next && or || after the start position
-			andPos := strings.Index(filter[startPos:], "&&")
-			orPos := strings.Index(filter[startPos:], "||")
-
-			endPos = len(filter)
-			if andPos >= 0 && (orPos < 0 || andPos < orPos) {
-				endPos = startPos + andPos
-			} else if orPos >= 0 {
-				endPos = startPos + orPos
+	definition, err := compiler.lookup(field)
+	if err != nil {
+		return nil, err
+	}
+	if comp.Arguments != nil {
+		return buildFunctionQuery(field, modifier, comp.Arguments)
+	}
+	// Patterns, lengths and lowercased values aren't compared to the field as stored
+	coerce := compiler.options.Field != nil && modifier != "length" && modifier != "lower" &&
+		comp.Operator != "~" && comp.Operator != "!~" && comp.Operator != "?~"
+	elementType := strings.TrimPrefix(definition.Type, "[]")
+
+	if comp.List != nil {
+		values := make([]interface{}, len(comp.List))
+		for i, item := range comp.List {
+			value, err := compiler.evaluate(item, item.Additive.EndPos.Offset)
+			if err != nil {
+				return nil, err
+			}
+			if coerce {
+				if value, err = compiler.coerce(field, elementType, value); err != nil {
+					return nil, &FilterError{Column: item.Additive.Pos.Column, Message: err.Error()}
+				}
 			}
+			values[i] = value
 		}
-
-		valueExprStr = strings.TrimSpace(filter[startPos:endPos])
+		if compiler.matchNothing {
+			// The filter is replaced as a whole
+			return bson.M{}, nil
+		}
+		if modifier == "each" {
+			if comp.NotIn {
+				return nil, errors.New(":each can't be used with not in")
+			}
+			if err := compiler.requireArray(field, ":each"); err != nil {
+				return nil, err
+			}
+			return bson.M{field: bson.M{"$all": values}}, nil
+		}
+		if comp.NotIn {
+			return bson.M{field: bson.M{"$nin": values}}, nil
+		}
+		return bson.M{field: bson.M{"$in": values}}, nil
 	}
 
-	// Evaluate the value expression into an interface{} value
-	value, err := evaluateValue(comp.Value, valueExprStr)
+	value, err := compiler.evaluate(comp.Value, comp.EndPos.Offset)
 	if err != nil {
-		return nil, fmt.Errorf("failed to evaluate value '%s': %v", valueExprStr, err)
+		return nil, err
+	}
+	if compiler.matchNothing {
+		return bson.M{}, nil
+	}
+	if coerce {
+		if value, err = compiler.coerce(field, elementType, value); err != nil {
+			return nil, &FilterError{Column: comp.Value.Additive.Pos.Column, Message: err.Error()}
+		}
+	}
+
+	switch comp.Operator {
+	case "?=", "?!=", "?~":
+		if modifier == "each" {
+			return nil, fmt.Errorf(":each can't be used with %s", comp.Operator)
+		}
+		if err := compiler.requireArray(field, comp.Operator); err != nil {
+			return nil, err
+		}
+		condition, err := elementCondition(strings.TrimPrefix(comp.Operator, "?"), value)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{field: bson.M{"$elemMatch": condition}}, nil
+	}
+	if modifier == "each" {
+		if err := compiler.requireArray(field, ":each"); err != nil {
+			return nil, err
+		}
+		condition, err := elementCondition(comp.Operator, value)
+		if err != nil {
+			return nil, err
+		}
+		// Every element matches when none of them doesn't
+		return bson.M{field: bson.M{"$type": "array", "$not": bson.M{"$elemMatch": bson.M{"$not": condition}}}}, nil
 	}
 
 	// Map operators to MongoDB operators
@@ -208,7 +369,243 @@ func buildComparisonQuery(comp *ComparisonExpression, filter string) (bson.M, er
 	}
 }
 
-func evaluateValue(valExpr *ValueExpression, exprStr string) (interface{}, error) {
+// evaluate evaluates a value of the filter ending at endOffset
+func (compiler *filterCompiler) evaluate(value *ValueExpression, endOffset int) (interface{}, error) {
+	filter := compiler.filter
+	startPos := value.Additive.Pos.Offset
+	endPos := endOffset
+
+	// If the end position is invalid, find the next logical operator or use end of filter
+	if endPos == 0 || endPos <= startPos {
+		// Look for the next && or || after the start position
+		andPos := strings.Index(filter[startPos:], "&&")
+		orPos := strings.Index(filter[startPos:], "||")
+
+		endPos = len(filter)
+		if andPos >= 0 && (orPos < 0 || andPos < orPos) {
+			endPos = startPos + andPos
+		} else if orPos >= 0 {
+			endPos = startPos + orPos
+		}
+	}
+	valueExprStr := strings.TrimSpace(filter[startPos:endPos])
+
+	// Evaluate the value expression into an interface{} value
+	result, err := compiler.evaluateValue(value, valueExprStr)
+	if err != nil {
+		return nil, &FilterError{
+			Column:  value.Additive.Pos.Column,
+			Message: fmt.Sprintf("failed to evaluate value '%s': %v", valueExprStr, err),
+		}
+	}
+	return result, nil
+}
+
+// lookup returns the definition of a field, rejecting the fields the options don't know
+func (compiler *filterCompiler) lookup(field string) (FieldDefinition, error) {
+	if compiler.options.Field == nil {
+		return FieldDefinition{}, nil
+	}
+	definition, ok := compiler.options.Field(field)
+	if !ok {
+		return FieldDefinition{}, fmt.Errorf("unknown field %s", field)
+	}
+	return definition, nil
+}
+
+// coerce converts a value to the type of the field it is compared to, so that ids match
+// ObjectIDs and enums only take their declared values
+func (compiler *filterCompiler) coerce(field string, fieldType string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if compiler.options.Enum != nil {
+		if enum, ok := compiler.options.Enum(fieldType); ok {
+			text := fmt.Sprint(value)
+			for _, allowed := range enum.Values {
+				if text == allowed {
+					return compiler.coerce(field, enum.Type, text)
+				}
+			}
+			return nil, fmt.Errorf("%s must be one of %s", field, strings.Join(enum.Values, ", "))
+		}
+	}
+	switch fieldType {
+	case "primitive.ObjectID":
+		if str, ok := value.(string); ok {
+			id, err := primitive.ObjectIDFromHex(str)
+			if err != nil {
+				return nil, fmt.Errorf("%s expects an id, got %q", field, str)
+			}
+			return id, nil
+		}
+	case "time.Time":
+		if str, ok := value.(string); ok {
+			date, err := time.Parse(time.RFC3339, str)
+			if err != nil {
+				return nil, fmt.Errorf("%s expects an RFC 3339 date, got %q", field, str)
+			}
+			return date, nil
+		}
+	case "string":
+		// Dates are stored as RFC 3339 strings, so @now can be compared to them
+		if date, ok := value.(time.Time); ok {
+			return date.UTC().Format(time.RFC3339), nil
+		}
+	case "int":
+		switch v := value.(type) {
+		case float64:
+			if v != math.Trunc(v) {
+				return nil, fmt.Errorf("%s expects an integer, got %v", field, v)
+			}
+			return int64(v), nil
+		case string:
+			number, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s expects an integer, got %q", field, v)
+			}
+			return number, nil
+		}
+	case "float64":
+		if str, ok := value.(string); ok {
+			number, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s expects a number, got %q", field, str)
+			}
+			return number, nil
+		}
+	case "bool":
+		if str, ok := value.(string); ok {
+			flag, err := strconv.ParseBool(str)
+			if err != nil {
+				return nil, fmt.Errorf("%s expects a boolean, got %q", field, str)
+			}
+			return flag, nil
+		}
+	}
+	return value, nil
+}
+
+// requireArray rejects the array operators on the fields the schema doesn't declare as arrays
+func (compiler *filterCompiler) requireArray(field string, operator string) error {
+	if compiler.options.Field == nil {
+		return nil
+	}
+	definition, ok := compiler.options.Field(field)
+	if ok && !strings.HasPrefix(definition.Type, "[]") {
+		return fmt.Errorf("%s can only be used on array fields, %s is %s", operator, field, definition.Type)
+	}
+	return nil
+}
+
+// elementCondition constructs the condition an element of an array is matched against
+func elementCondition(operator string, value interface{}) (bson.M, error) {
+	switch operator {
+	case "=":
+		return bson.M{"$eq": value}, nil
+	case "!=":
+		return bson.M{"$ne": value}, nil
+	case ">":
+		return bson.M{"$gt": value}, nil
+	case ">=":
+		return bson.M{"$gte": value}, nil
+	case "<":
+		return bson.M{"$lt": value}, nil
+	case "<=":
+		return bson.M{"$lte": value}, nil
+	case "~", "!~":
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s operator requires a string pattern", operator)
+		}
+		if operator == "!~" {
+			return bson.M{"$not": bson.M{"$regex": convertPatternToRegex(str)}}, nil
+		}
+		return bson.M{"$regex": convertPatternToRegex(str)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported operator: %s", operator)
+	}
+}
+
+// earthRadiusInMeters converts distances to the radians expected by $centerSphere
+const earthRadiusInMeters = 6378100.0
+
+// buildFunctionQuery constructs a MongoDB query from a field function. Coordinates are
+// written latitude first, as they are usually read, and stored longitude first as GeoJSON.
+func buildFunctionQuery(field string, function string, arguments []*SignedNumber) (bson.M, error) {
+	values := make([]float64, len(arguments))
+	for i, argument := range arguments {
+		values[i] = argument.Value
+		if argument.Negative {
+			values[i] = -argument.Value
+		}
+	}
+	switch function {
+	case "near":
+		// near(latitude, longitude, maxDistanceInMeters)
+		if len(values) != 3 {
+			return nil, errors.New("near requires a latitude, a longitude and a distance in meters")
+		}
+		return bson.M{field: bson.M{"$geoWithin": bson.M{
+			"$centerSphere": bson.A{bson.A{values[1], values[0]}, values[2] / earthRadiusInMeters},
+		}}}, nil
+	case "within":
+		// within(lat1, lng1, lat2, lng2, lat3, lng3, ...), the polygon is closed automatically
+		if len(values) < 6 || len(values)%2 != 0 {
+			return nil, errors.New("within requires at least three latitude, longitude pairs")
+		}
+		ring := bson.A{}
+		for i := 0; i < len(values); i += 2 {
+			ring = append(ring, bson.A{values[i+1], values[i]})
+		}
+		if values[0] != values[len(values)-2] || values[1] != values[len(values)-1] {
+			ring = append(ring, bson.A{values[1], values[0]})
+		}
+		return bson.M{field: bson.M{"$geoWithin": bson.M{
+			"$geometry": bson.M{"type": "Polygon", "coordinates": bson.A{ring}},
+		}}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported function: %s", function)
+	}
+}
+
+// FindNearPoint returns the field and the [longitude, latitude] center of the first near()
+// condition that every match of the query has to satisfy.
+func FindNearPoint(query bson.M) (string, bson.A, bool) {
+	for key, value := range query {
+		if key == "$and" {
+			if clauses, ok := value.([]bson.M); ok {
+				for _, clause := range clauses {
+					if field, point, ok := FindNearPoint(clause); ok {
+						return field, point, true
+					}
+				}
+			}
+			continue
+		}
+		condition, ok := value.(bson.M)
+		if !ok {
+			continue
+		}
+		within, ok := condition["$geoWithin"].(bson.M)
+		if !ok {
+			continue
+		}
+		if sphere, ok := within["$centerSphere"].(bson.A); ok && len(sphere) == 2 {
+			if point, ok := sphere[0].(bson.A); ok {
+				return key, point, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+func (compiler *filterCompiler) evaluateValue(valExpr *ValueExpression, exprStr string) (interface{}, error) {
+	// Arithmetic is left to the expr library
+	if len(valExpr.Additive.Ops) > 0 || len(valExpr.Additive.Left.Ops) > 0 {
+		return compiler.evaluateExpr(exprStr)
+	}
+
 	// Handle simple literal values directly from the AST
 	primary := valExpr.Additive.Left.Left
 	if primary.String != nil {
@@ -224,51 +621,89 @@ func evaluateValue(valExpr *ValueExpression, exprStr string) (interface{}, error
 		return nil, nil
 	}
 	if primary.Macro != nil {
-		return evaluateMacro(*primary.Macro)
+		return compiler.evaluateMacro(*primary.Macro)
 	}
 	if primary.SubExpr != nil {
-		return evaluateExpr(exprStr)
+		return compiler.evaluateExpr(exprStr)
 	}
 
-	// Check if we have a complex expression (with operators)
-	hasOps := len(valExpr.Additive.Ops) > 0
-	if hasOps || exprStr != "" {
-		return evaluateExpr(exprStr)
+	if exprStr != "" {
+		return compiler.evaluateExpr(exprStr)
 	}
 
 	return nil, fmt.Errorf("unable to evaluate value expression")
 }
 
-// evaluateMacro handles macro values like @now
-func evaluateMacro(macro string) (interface{}, error) {
+// evaluateMacro handles macro values like @now, the calendar ones being midnight in the
+// time zone of the options
+func (compiler *filterCompiler) evaluateMacro(macro string) (interface{}, error) {
+	location := compiler.options.Location
+	if location == nil {
+		location = time.UTC
+	}
+	year, month, day := compiler.now.In(location).Date()
 	switch macro {
 	case "@now":
-		return time.Now(), nil
-	default:
-		return nil, fmt.Errorf("unsupported macro: %s", macro)
+		return compiler.now, nil
+	case "@today":
+		return time.Date(year, month, day, 0, 0, 0, 0, location), nil
+	case "@yesterday":
+		return time.Date(year, month, day-1, 0, 0, 0, 0, location), nil
+	case "@month_start":
+		return time.Date(year, month, 1, 0, 0, 0, 0, location), nil
+	case "@year_start":
+		return time.Date(year, time.January, 1, 0, 0, 0, 0, location), nil
 	}
+	if compiler.options.Macro != nil {
+		value, ok, err := compiler.options.Macro(strings.TrimPrefix(macro, "@"))
+		if errors.Is(err, ErrNoMatch) {
+			compiler.matchNothing = true
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return value, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported macro: %s", macro)
 }
 
+var macroPattern = regexp.MustCompile(`^@[a-zA-Z_][a-zA-Z0-9_]*(\.[a-zA-Z_][a-zA-Z0-9_]*)*$`)
+
+var macroReference = regexp.MustCompile(`@[a-zA-Z_][a-zA-Z0-9_]*(\.[a-zA-Z_][a-zA-Z0-9_]*)*`)
+
 // evaluateExpr evaluates arithmetic expressions using the expr library
-func evaluateExpr(exprStr string) (interface{}, error) {
+func (compiler *filterCompiler) evaluateExpr(exprStr string) (interface{}, error) {
 	// Clean up the expression string
 	exprStr = strings.TrimSpace(exprStr)
 
 	// If it's a simple macro reference, handle directly
-	if strings.HasPrefix(exprStr, "@") {
-		return evaluateMacro(exprStr)
+	if macroPattern.MatchString(exprStr) {
+		return compiler.evaluateMacro(exprStr)
 	}
 
-	// Define environment with macros
-	env := map[string]interface{}{
-		"now": func() float64 {
-			return float64(time.Now().UnixNano()) / 1e6 // milliseconds
-		},
+	// Macros become variables of the expression, dates in milliseconds
+	env := map[string]interface{}{}
+	var macroErr error
+	exprStr = macroReference.ReplaceAllStringFunc(exprStr, func(macro string) string {
+		value, err := compiler.evaluateMacro(macro)
+		if err != nil && macroErr == nil {
+			macroErr = err
+		}
+		if date, ok := value.(time.Time); ok {
+			value = float64(date.UnixNano()) / 1e6
+		}
+		name := fmt.Sprintf("macro%d", len(env))
+		env[name] = value
+		return name
+	})
+	if macroErr != nil {
+		return nil, macroErr
 	}
-
-	// Preprocess expression to handle @macros
-	if strings.Contains(exprStr, "@now") {
-		exprStr = strings.ReplaceAll(exprStr, "@now", "now()")
+	if compiler.matchNothing {
+		return nil, nil
 	}
 
 	// Parse and evaluate the expression
@@ -0,0 +1,334 @@
+package utils
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var testFields = map[string]FieldDefinition{
+	"_id":          {Type: "primitive.ObjectID"},
+	"name":         {Type: "string"},
+	"age":          {Type: "int"},
+	"score":        {Type: "float64"},
+	"active":       {Type: "bool"},
+	"status":       {Type: "Status"},
+	"level":        {Type: "Level"},
+	"tags":         {Type: "[]string"},
+	"counts":       {Type: "[]int"},
+	"owner_id":     {Type: "primitive.ObjectID"},
+	"created_at":   {Type: "time.Time"},
+	"updated_at":   {Type: "string"},
+	"address.city": {Type: "string"},
+}
+
+var testEnums = map[string]EnumDefinition{
+	"Status": {Type: "string", Values: []string{"draft", "published"}},
+	"Level":  {Type: "int", Values: []string{"1", "2", "3"}},
+}
+
+func testOptions() FilterOptions {
+	return FilterOptions{
+		Field: func(name string) (FieldDefinition, bool) {
+			field, ok := testFields[name]
+			return field, ok
+		},
+		Enum: func(name string) (EnumDefinition, bool) {
+			enum, ok := testEnums[name]
+			return enum, ok
+		},
+	}
+}
+
+func TestFilterPrecedence(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   bson.M
+	}{
+		{
+			`name = "a" || name = "b" && age > 1`,
+			bson.M{"$or": []bson.M{
+				{"name": "a"},
+				{"$and": []bson.M{{"name": "b"}, {"age": bson.M{"$gt": 1.0}}}},
+			}},
+		},
+		{
+			`(name = "a" || name = "b") && age > 1`,
+			bson.M{"$and": []bson.M{
+				{"$or": []bson.M{{"name": "a"}, {"name": "b"}}},
+				{"age": bson.M{"$gt": 1.0}},
+			}},
+		},
+		{
+			`name = "a" && age > 1 && active = true`,
+			bson.M{"$and": []bson.M{{"name": "a"}, {"age": bson.M{"$gt": 1.0}}, {"active": true}}},
+		},
+		{
+			`!name = "a"`,
+			bson.M{"$nor": []bson.M{{"name": "a"}}},
+		},
+		{
+			`!(name = "a" || age = 2) && active = true`,
+			bson.M{"$and": []bson.M{
+				{"$nor": []bson.M{{"$or": []bson.M{{"name": "a"}, {"age": 2.0}}}}},
+				{"active": true},
+			}},
+		},
+		{
+			`!!name = "a"`,
+			bson.M{"$nor": []bson.M{{"$nor": []bson.M{{"name": "a"}}}}},
+		},
+	}
+	for _, test := range tests {
+		got, err := TransformFilterToMongoQuery(test.filter)
+		if err != nil {
+			t.Errorf("%s: %v", test.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\n got %v\nwant %v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestFilterErrorColumns(t *testing.T) {
+	tests := []struct {
+		filter  string
+		column  int
+		message string
+	}{
+		{`name = `, 8, ""},
+		{`name = "a" &&`, 14, ""},
+		{`(name = "a"`, 12, ""},
+		{`unknown = 1`, 1, "unknown field unknown"},
+		{`name = "a" && nope = 1`, 15, "unknown field nope"},
+		{`age = "x"`, 7, "age expects an integer"},
+		{`age in (1, "x")`, 12, "age expects an integer"},
+		{`status = "archived"`, 10, "status must be one of draft, published"},
+		{`name ?= "a"`, 1, "?= can only be used on array fields"},
+		{`name = @unknown`, 8, "unsupported macro: @unknown"},
+	}
+	for _, test := range tests {
+		_, err := TransformFilterToMongoQueryWithOptions(test.filter, testOptions())
+		var filterErr *FilterError
+		if !errors.As(err, &filterErr) {
+			t.Errorf("%s: got %v, want a FilterError", test.filter, err)
+			continue
+		}
+		if filterErr.Column != test.column {
+			t.Errorf("%s: got column %d, want %d (%s)", test.filter, filterErr.Column, test.column, filterErr.Message)
+		}
+		if !strings.Contains(filterErr.Message, test.message) {
+			t.Errorf("%s: got %q, want %q", test.filter, filterErr.Message, test.message)
+		}
+	}
+}
+
+func TestFilterCoercion(t *testing.T) {
+	id := primitive.NewObjectID()
+	date := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		filter string
+		want   bson.M
+	}{
+		{`_id = "` + id.Hex() + `"`, bson.M{"_id": id}},
+		{`owner_id != "` + id.Hex() + `"`, bson.M{"owner_id": bson.M{"$ne": id}}},
+		{`age = 42`, bson.M{"age": int64(42)}},
+		{`age = "42"`, bson.M{"age": int64(42)}},
+		{`score > "1.5"`, bson.M{"score": bson.M{"$gt": 1.5}}},
+		{`active = "true"`, bson.M{"active": true}},
+		{`status = "draft"`, bson.M{"status": "draft"}},
+		{`level = 2`, bson.M{"level": int64(2)}},
+		{`created_at >= "2024-03-01T12:00:00Z"`, bson.M{"created_at": bson.M{"$gte": date}}},
+		{`name = null`, bson.M{"name": nil}},
+		// Patterns are matched against the text, not the type of the field
+		{`name ~ "jo%"`, bson.M{"name": bson.M{"$regex": "^jo.*$"}}},
+	}
+	for _, test := range tests {
+		got, err := TransformFilterToMongoQueryWithOptions(test.filter, testOptions())
+		if err != nil {
+			t.Errorf("%s: %v", test.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\n got %v\nwant %v", test.filter, got, test.want)
+		}
+	}
+
+	for _, filter := range []string{
+		`_id = "not-an-id"`,
+		`age = 1.5`,
+		`score = "many"`,
+		`active = "yes"`,
+		`created_at > "yesterday"`,
+		`level = 4`,
+	} {
+		if _, err := TransformFilterToMongoQueryWithOptions(filter, testOptions()); err == nil {
+			t.Errorf("%s: expected an error", filter)
+		}
+	}
+}
+
+func TestFilterArrays(t *testing.T) {
+	id := primitive.NewObjectID()
+	tests := []struct {
+		filter string
+		want   bson.M
+	}{
+		{`name in ("a", "b")`, bson.M{"name": bson.M{"$in": []interface{}{"a", "b"}}}},
+		{`name not in ("a", "b")`, bson.M{"name": bson.M{"$nin": []interface{}{"a", "b"}}}},
+		{`age not in (1, "2")`, bson.M{"age": bson.M{"$nin": []interface{}{int64(1), int64(2)}}}},
+		{`owner_id in ("` + id.Hex() + `")`, bson.M{"owner_id": bson.M{"$in": []interface{}{id}}}},
+		{`tags in ("a")`, bson.M{"tags": bson.M{"$in": []interface{}{"a"}}}},
+		{`tags:each in ("a", "b")`, bson.M{"tags": bson.M{"$all": []interface{}{"a", "b"}}}},
+		{`tags ?= "a"`, bson.M{"tags": bson.M{"$elemMatch": bson.M{"$eq": "a"}}}},
+		{`tags ?!= "a"`, bson.M{"tags": bson.M{"$elemMatch": bson.M{"$ne": "a"}}}},
+		{`tags ?~ "a%"`, bson.M{"tags": bson.M{"$elemMatch": bson.M{"$regex": "^a.*$"}}}},
+		{`counts ?= "3"`, bson.M{"counts": bson.M{"$elemMatch": bson.M{"$eq": int64(3)}}}},
+		{
+			`tags:each != "a"`,
+			bson.M{"tags": bson.M{"$type": "array", "$not": bson.M{"$elemMatch": bson.M{"$not": bson.M{"$ne": "a"}}}}},
+		},
+		{
+			`counts:each > 1`,
+			bson.M{"counts": bson.M{"$type": "array", "$not": bson.M{"$elemMatch": bson.M{"$not": bson.M{"$gt": int64(1)}}}}},
+		},
+		{`tags:length = 2`, bson.M{"tags": bson.M{"$size": 2}}},
+	}
+	for _, test := range tests {
+		got, err := TransformFilterToMongoQueryWithOptions(test.filter, testOptions())
+		if err != nil {
+			t.Errorf("%s: %v", test.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\n got %v\nwant %v", test.filter, got, test.want)
+		}
+	}
+
+	for _, filter := range []string{
+		`name:each in ("a")`,
+		`tags:each not in ("a")`,
+		`name:each = "a"`,
+		`age ?= 1`,
+		`tags:each ?= "a"`,
+		`counts in (1, "x")`,
+	} {
+		if _, err := TransformFilterToMongoQueryWithOptions(filter, testOptions()); err == nil {
+			t.Errorf("%s: expected an error", filter)
+		}
+	}
+}
+
+func TestFilterMacros(t *testing.T) {
+	id := primitive.NewObjectID()
+	options := testOptions()
+	options.Macro = func(name string) (interface{}, bool, error) {
+		switch name {
+		case "request.auth.id":
+			return id.Hex(), true, nil
+		case "request.auth.anonymous":
+			return nil, false, ErrNoMatch
+		}
+		return nil, false, nil
+	}
+	tests := []struct {
+		filter string
+		want   bson.M
+	}{
+		{`owner_id = @request.auth.id`, bson.M{"owner_id": id}},
+		{`owner_id in (@request.auth.id)`, bson.M{"owner_id": bson.M{"$in": []interface{}{id}}}},
+		{`owner_id = @request.auth.anonymous`, matchNothing()},
+		{`name = "a" || owner_id = @request.auth.anonymous`, matchNothing()},
+	}
+	for _, test := range tests {
+		got, err := TransformFilterToMongoQueryWithOptions(test.filter, options)
+		if err != nil {
+			t.Errorf("%s: %v", test.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\n got %v\nwant %v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestFilterCalendarMacros(t *testing.T) {
+	location := time.FixedZone("UTC+3", 3*60*60)
+	options := testOptions()
+	options.Location = location
+	before := time.Now()
+	now := before.In(location)
+	year, month, day := now.Date()
+	tests := []struct {
+		macro string
+		want  time.Time
+	}{
+		{"@today", time.Date(year, month, day, 0, 0, 0, 0, location)},
+		{"@yesterday", time.Date(year, month, day-1, 0, 0, 0, 0, location)},
+		{"@month_start", time.Date(year, month, 1, 0, 0, 0, 0, location)},
+		{"@year_start", time.Date(year, time.January, 1, 0, 0, 0, 0, location)},
+	}
+	for _, test := range tests {
+		got, err := TransformFilterToMongoQueryWithOptions("created_at >= "+test.macro, options)
+		if err != nil {
+			t.Errorf("%s: %v", test.macro, err)
+			continue
+		}
+		value, _ := got["created_at"].(bson.M)["$gte"].(time.Time)
+		if !value.Equal(test.want) {
+			t.Errorf("%s: got %v, want %v", test.macro, value, test.want)
+		}
+	}
+
+	// Dates stored as strings are compared to RFC 3339 strings
+	got, err := TransformFilterToMongoQueryWithOptions("updated_at < @now", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := got["updated_at"].(bson.M)["$lt"].(string)
+	if _, err := time.Parse(time.RFC3339, value); err != nil {
+		t.Errorf("@now on a string field: got %q, want an RFC 3339 date", value)
+	}
+
+	// Arithmetic on dates is done in milliseconds
+	got, err = TransformFilterToMongoQueryWithOptions("created_at > @now - 86400000", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date, _ := got["created_at"].(bson.M)["$gt"].(time.Time)
+	if lag := before.Sub(date); lag < 23*time.Hour || lag > 25*time.Hour {
+		t.Errorf("@now - 1 day: got %v", date)
+	}
+}
+
+func TestFilterDotPaths(t *testing.T) {
+	got, err := TransformFilterToMongoQueryWithOptions(`address.city = "Dakar" && !address.city = "Thiès"`, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{"$and": []bson.M{{"address.city": "Dakar"}, {"$nor": []bson.M{{"address.city": "Thiès"}}}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := TransformFilterToMongoQueryWithOptions(`address.zip = "1"`, testOptions()); err == nil {
+		t.Error("address.zip: expected an error")
+	}
+}
+
+func TestFilterWithoutOptions(t *testing.T) {
+	// Without a schema fields aren't checked and values are kept as parsed
+	got, err := TransformFilterToMongoQuery(`anything = "1" && other > 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{"$and": []bson.M{{"anything": "1"}, {"other": bson.M{"$gt": 2.0}}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -19,6 +19,16 @@ type FieldDefinition struct {
 	BSONTag    string
 	DBTag      string
 	Validation string
+	SchemaType string      // The "type" key of the schema, e.g. "enum" or "geo_point"
+	Expr       string      // Expression of a computed field
+	Stored     bool        // Whether a computed field is saved with the record
+	Default    interface{} // Value set on create when the client doesn't send the field
+	ReadOnly   bool        // Whether clients are forbidden to send the field
+	Hidden     bool        // Never sent to nor accepted from clients
+	WriteOnly  bool        // Accepted from clients but never sent back
+	AdminOnly  bool        // Only sent to superusers
+	Encryption string      // "randomized" or "deterministic" for the fields stored encrypted
+	Unique     bool        // Whether an encrypted field is unique, which only deterministic ones can be
 }
 
 type EnumDefinition struct {
@@ -74,8 +84,29 @@ func ParseStruct(name string, data map[string]interface{}, structs map[string]*S
 
 		switch v := value.(type) {
 		case map[string]interface{}:
-			// Check if it's an enum
-			if typ, ok := v["type"].(string); ok && typ == "enum" {
+			if typ, ok := v["type"].(string); ok {
+				field.SchemaType = typ
+			}
+			if _, isLeaf := v["value"]; isLeaf || field.SchemaType != "" {
+				field.Default = v["default"]
+				field.ReadOnly, _ = v["readonly"].(bool)
+				field.Hidden, _ = v["hidden"].(bool)
+				field.WriteOnly, _ = v["write_only"].(bool)
+				field.AdminOnly, _ = v["admin_only"].(bool)
+			}
+			if field.SchemaType == "geo_point" {
+				// GeoJSON point, stored as {"type": "Point", "coordinates": [longitude, latitude]}
+				pointName := fmt.Sprintf("%s%s", name, field.Name)
+				structs[pointName] = &StructDefinition{
+					Name: pointName,
+					Fields: []FieldDefinition{
+						{Name: "Type", Type: "string", JSONTag: "type", BSONTag: "type", Validation: "omitempty,eq=Point"},
+						{Name: "Coordinates", Type: "[]float64", JSONTag: "coordinates", BSONTag: "coordinates", Validation: "omitempty,len=2"},
+					},
+				}
+				field.Type = pointName
+			} else if field.SchemaType == "enum" {
+				// Check if it's an enum
 				if vals, ok := v["values"].([]interface{}); ok && len(vals) > 0 {
 					// Determine the enum type based on the first value
 					enumType := GetGoType(vals[0])
@@ -90,6 +121,17 @@ func ParseStruct(name string, data map[string]interface{}, structs map[string]*S
 					// Add validation
 					field.Validation = "oneof=" + strings.Join(strVals, " ")
 				}
+			} else if field.SchemaType == "computed" {
+				// Evaluated from the other fields of the record, never sent by clients
+				field.Expr, _ = v["expr"].(string)
+				field.Stored, _ = v["stored"].(bool)
+				field.Type = "interface{}"
+				if val, ok := v["value"]; ok {
+					field.Type = GetGoType(val)
+				}
+				if !field.Stored {
+					field.BSONTag = "-"
+				}
 			} else if val, ok := v["value"]; ok {
 				// Handle fields with validation
 				field.Type = GetGoType(val)
@@ -103,6 +145,14 @@ func ParseStruct(name string, data map[string]interface{}, structs map[string]*S
 					if dbTag == "autogenerate" {
 						field.Type = "primitive.ObjectID"
 					}
+					if dbTag == "encrypted" {
+						// Randomized unless equality filters are needed
+						field.Encryption = "randomized"
+						if mode, ok := v["encryption"].(string); ok && mode == "deterministic" {
+							field.Encryption = mode
+						}
+						field.Unique, _ = v["unique"].(bool)
+					}
 				}
 			} else {
 				// Nested struct